@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Where subscriptions subscribe and unsubscribe: the registry of a Client,
+// or a FakeClient
+type registry interface {
+	Subscribe(s *Subscription)
+	Unsubscribe(s *Subscription)
+}
+
 type Subscription struct {
-	sr *subscriptionRegistry
+	sr registry
 
 	// Reference the connection the subscription was subscribed on
 	c *Connection
@@ -41,6 +49,10 @@ func (s *Subscription) SetSubject(v string) {
 	s.subject = v
 }
 
+func (s *Subscription) Subject() string {
+	return s.subject
+}
+
 func (s *Subscription) SetQueue(v string) {
 	if s.frozen {
 		panic("subscription is frozen")
@@ -57,6 +69,16 @@ func (s *Subscription) SetMaximum(v uint) {
 	s.maximum = v
 }
 
+// Number of messages the inbox holds before delivery blocks, unbuffered by
+// default
+func (s *Subscription) SetBuffer(v int) {
+	if s.frozen {
+		panic("subscription is frozen")
+	}
+
+	s.Inbox = make(chan *readMessage, v)
+}
+
 // Proxy to registry
 func (s *Subscription) Subscribe() {
 	s.sr.Subscribe(s)
@@ -117,6 +139,11 @@ func (s *Subscription) deliver(m *readMessage) {
 	s.Inbox <- m
 }
 
+// Messages in the inbox that were not yet received
+func (s *Subscription) pending() int {
+	return len(s.Inbox)
+}
+
 func (s *Subscription) isDone() bool {
 	return s.maximum > 0 && s.received >= s.maximum
 }
@@ -172,9 +199,30 @@ func (sr *subscriptionRegistry) Resubscribe(c *Connection) {
 	sr.Lock()
 	defer sr.Unlock()
 
+	var sids = make([]uint, 0, len(sr.m))
+	for sid := range sr.m {
+		sids = append(sids, sid)
+	}
+
+	// In the order the subscriptions were made, so the commands a reconnect
+	// sends don't depend on map order
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+
+	for _, sid := range sids {
+		sr.m[sid].subscribe(c)
+	}
+}
+
+// Messages queued across all subscriptions
+// Expects to be called when the registry lock is held
+func (sr *subscriptionRegistry) pending() int {
+	var n int
+
 	for _, s := range sr.m {
-		s.subscribe(c)
+		n += s.pending()
 	}
+
+	return n
 }
 
 func (sr *subscriptionRegistry) Subscribe(s *Subscription) {
@@ -192,11 +240,17 @@ func (sr *subscriptionRegistry) Unsubscribe(s *Subscription) {
 	sr.Lock()
 	defer sr.Unlock()
 
+	// Already unsubscribed, possibly after receiving its maximum
+	if _, ok := sr.m[s.sid]; !ok {
+		return
+	}
+
 	delete(sr.m, s.sid)
 	s.unsubscribe()
 }
 
-func (sr *subscriptionRegistry) Deliver(m *readMessage) {
+// Deliver message to its subscription, returns false if there is none
+func (sr *subscriptionRegistry) Deliver(m *readMessage) bool {
 	var s *Subscription
 	var ok bool
 
@@ -205,6 +259,12 @@ func (sr *subscriptionRegistry) Deliver(m *readMessage) {
 
 	s, ok = sr.m[m.SubscriptionId]
 	if ok {
+		// Report the message as pending too while a slow subscriber holds up
+		// delivery
+		if sr.Metrics != nil {
+			sr.Metrics.subscriptions(len(sr.m), sr.pending()+1)
+		}
+
 		s.deliver(m)
 
 		// Unsubscribe if the maximum number of messages has been received
@@ -213,14 +273,66 @@ func (sr *subscriptionRegistry) Deliver(m *readMessage) {
 			s.unsubscribe()
 		}
 	}
+
+	if sr.Metrics != nil {
+		sr.Metrics.subscriptions(len(sr.m), sr.pending())
+	}
+
+	return ok
 }
 
+const (
+	DefaultPingInterval        = 2 * time.Minute
+	DefaultMaxPingsOutstanding = 2
+)
+
 type Client struct {
 	subscriptionRegistry
 	Stopper
 
+	// Interval between keepalive PINGs, zero disables keepalive
+	PingInterval time.Duration
+
+	// Number of keepalive PINGs that may go unanswered before the connection
+	// is considered stale and the client reconnects
+	MaxPingsOutstanding uint
+
 	cc chan *Connection
-	r  *rand.Rand
+
+	// Source of inbox names, seeded from the clock on first use
+	r     *rand.Rand
+	rLock sync.Mutex
+
+	// Connection currently running, if any
+	conn     *Connection
+	connLock sync.Mutex
+
+	// Called when the client connects to a server with another server_id
+	// than the previous one, which means messages may have been lost in
+	// between. Runs on the goroutine that called Run.
+	ServerChanged func(previous, current *ServerInfo)
+
+	// Where the client reports reconnects and dropped messages, if set
+	Logger Logger
+
+	// Hook that propagates trace context through published and delivered
+	// messages, if set
+	Tracer Tracer
+
+	// Where the client records publish latency, message counts, reconnects
+	// and round trip times, if set
+	Metrics *Metrics
+
+	// Source of time for timeouts, keepalive and latency measurements, and
+	// the seed of inbox names. Uses SystemClock if nil.
+	Clock Clock
+
+	// Latest INFO sent by the server
+	info     *ServerInfo
+	infoLock sync.Mutex
+
+	// Whether the handshake negotiated headers for the current session
+	headers bool
 }
 
 func NewClient() *Client {
@@ -228,8 +340,10 @@ func NewClient() *Client {
 
 	t.subscriptionRegistry.setup(t)
 
+	t.PingInterval = DefaultPingInterval
+	t.MaxPingsOutstanding = DefaultMaxPingsOutstanding
+
 	t.cc = make(chan *Connection)
-	t.r = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	return t
 }
@@ -264,40 +378,183 @@ func (t *Client) Ping() bool {
 	return c.Ping()
 }
 
-func (t *Client) publish(s string, r string, m []byte, confirm bool) bool {
+// Measure the duration of a PING/PONG round trip on the current connection
+func (t *Client) RTT() (time.Duration, bool) {
+	c := t.AcquireConnection()
+	if c == nil {
+		return 0, false
+	}
+
+	return c.RTT()
+}
+
+// Smoothed round trip time of the current connection, including keepalive
+// PINGs, zero if unknown or not connected
+func (t *Client) EstimatedRTT() time.Duration {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	if t.conn == nil {
+		return 0
+	}
+
+	return t.conn.EstimatedRTT()
+}
+
+// Latest information the server sent about itself, nil if unknown. The
+// returned value must not be modified.
+func (t *Client) ServerInfo() *ServerInfo {
+	t.infoLock.Lock()
+	defer t.infoLock.Unlock()
+
+	return t.info
+}
+
+func (t *Client) setInfo(info *ServerInfo) {
+	t.infoLock.Lock()
+	defer t.infoLock.Unlock()
+
+	// Headers is what the handshake negotiated, whatever a later INFO says
+	// the server supports
+	var i = *info
+	i.Headers = t.headers
+	t.info = &i
+}
+
+func (t *Client) negotiatedHeaders() bool {
+	t.infoLock.Lock()
+	defer t.infoLock.Unlock()
+
+	return t.headers
+}
+
+func (t *Client) setNegotiatedHeaders(headers bool) {
+	t.infoLock.Lock()
+	defer t.infoLock.Unlock()
+
+	t.headers = headers
+}
+
+// Handle INFO from the handshake or sent during the session, which may
+// update the cluster topology
+func (t *Client) updateInfo(d Dialer, info *ServerInfo) {
+	t.setInfo(info)
+
+	// Servers that don't send connect_urls don't change the topology
+	if info.ConnectUrls == nil {
+		return
+	}
+
+	if dd, ok := d.(DiscoveringDialer); ok {
+		dd.Discover(info.ConnectUrls)
+	}
+}
+
+func (t *Client) setConnection(c *Connection) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	t.conn = c
+}
+
+// Add trace context to a message about to be published: as a header if the
+// session negotiated them, in an envelope around the payload if not
+func (t *Client) trace(s string, parent TraceContext, h Header, m []byte) (Header, []byte) {
+	if t.Tracer == nil {
+		return h, m
+	}
+
+	var tc = t.Tracer.Publish(s, parent)
+	if !tc.IsValid() {
+		return h, m
+	}
+
+	if !t.negotiatedHeaders() {
+		return h, traceEnvelope(tc, m)
+	}
+
+	// Don't modify the caller's header
+	var th = make(Header, len(h)+1)
+	for k, v := range h {
+		th[k] = v
+	}
+
+	th.Set(TraceparentHeader, tc.String())
+
+	return th, m
+}
+
+func (t *Client) publish(s string, r string, h Header, m []byte, parent TraceContext, confirm bool) bool {
 	var o = new(writePublish)
 
-	o.Subject = s
-	o.ReplyTo = r
-	o.Message = m
+	// Fail the publish rather than the connection, which couldn't write it
+	if h.validate() != nil {
+		return false
+	}
 
 	c := t.AcquireConnection()
 	if c == nil {
 		return false
 	}
 
-	ok := c.Write(o)
-	if !ok {
+	// The server would drop the connection on HPUB
+	if len(h) > 0 && !t.negotiatedHeaders() {
 		return false
 	}
 
-	// Round trip to confirm the publish was received
+	h, m = t.trace(s, parent, h, m)
+
+	o.Subject = s
+	o.ReplyTo = r
+	o.Header = h
+	o.Message = m
+
+	var start = t.clock().Now()
+	var ok bool
+
+	// Wait for the server to confirm the publish was received
 	if confirm {
-		return c.Ping()
+		ok = c.WriteAndConfirm(o)
+	} else {
+		ok = c.Write(o)
 	}
 
-	return true
+	t.Metrics.published(len(m), t.clock().Now().Sub(start), ok)
+
+	return ok
 }
 
 func (t *Client) Publish(s string, m []byte) bool {
-	return t.publish(s, "", m, false)
+	return t.publish(s, "", nil, m, TraceContext{}, false)
 }
 
 func (t *Client) PublishAndConfirm(s string, m []byte) bool {
-	return t.publish(s, "", m, true)
+	return t.publish(s, "", nil, m, TraceContext{}, true)
+}
+
+// Publish with a header; fails if the server doesn't support headers
+func (t *Client) PublishWithHeader(s string, h Header, m []byte) bool {
+	return t.publish(s, "", h, m, TraceContext{}, false)
+}
+
+// Publish with a subject the receiver should reply to
+func (t *Client) PublishWithReply(s string, r string, m []byte) bool {
+	return t.publish(s, r, nil, m, TraceContext{}, false)
+}
+
+// Publish as part of the trace of parent, such as a reply to a message that
+// carried trace context. Only differs from Publish if a Tracer is set.
+func (t *Client) PublishTraced(s string, parent TraceContext, m []byte) bool {
+	return t.publish(s, "", nil, m, parent, false)
 }
 
 func (t *Client) Request(s string, m []byte, f func(*Subscription)) bool {
+	return t.RequestTraced(s, TraceContext{}, m, f)
+}
+
+// Request as part of the trace of parent. Only differs from Request if a
+// Tracer is set.
+func (t *Client) RequestTraced(s string, parent TraceContext, m []byte, f func(*Subscription)) bool {
 	r := t.createInbox()
 
 	sub := t.NewSubscription(r)
@@ -305,25 +562,44 @@ func (t *Client) Request(s string, m []byte, f func(*Subscription)) bool {
 
 	go f(sub)
 
-	return t.publish(s, r, m, false)
+	return t.publish(s, r, nil, m, parent, false)
+}
+
+func (t *Client) clock() Clock {
+	return clockOrSystem(t.Clock)
 }
 
 func (t *Client) createInbox() string {
+	t.rLock.Lock()
+	defer t.rLock.Unlock()
+
+	if t.r == nil {
+		t.r = rand.New(rand.NewSource(t.clock().Now().UnixNano()))
+	}
+
 	return fmt.Sprintf("_INBOX.%04x%04x%04x%04x%04x%06x",
 		t.r.Int31n(0x10000), t.r.Int31n(0x10000), t.r.Int31n(0x10000),
 		t.r.Int31n(0x10000), t.r.Int31n(0x10000), t.r.Int31n(0x1000000))
 }
 
-func (t *Client) runConnection(n net.Conn, sc chan bool) error {
+func (t *Client) runConnection(d Dialer, n net.Conn, verbose bool, sc chan bool) error {
 	var e error
 	var c *Connection
 	var dc chan bool
+	var fc chan bool
 
 	c = NewConnection(n)
+	c.SetVerbose(verbose)
+	c.SetKeepAlive(t.PingInterval, t.MaxPingsOutstanding)
+	c.SetRTTHandler(t.Metrics.rtt)
+	c.SetClock(t.Clock)
 	dc = make(chan bool)
+	fc = make(chan bool)
 
 	// Feed connection until stop
 	go func() {
+		defer close(fc)
+
 		var ccc chan chan *Connection = make(chan chan *Connection, 1)
 		var cc chan *Connection
 
@@ -353,14 +629,34 @@ func (t *Client) runConnection(n net.Conn, sc chan bool) error {
 		for o = range c.oc {
 			switch oo := o.(type) {
 			case *readMessage:
-				t.Deliver(oo)
+				extractTrace(oo)
+				if t.Tracer != nil && oo.Trace.IsValid() {
+					t.Tracer.Deliver(string(oo.Subscription), oo.Trace)
+				}
+
+				var ok = t.Deliver(oo)
+				if !ok {
+					logTo(t.Logger, LogDebug, "dropped message without subscription",
+						"subject", string(oo.Subscription), "sid", oo.SubscriptionId)
+				}
+
+				t.Metrics.received(string(oo.Subscription), len(oo.Payload), ok)
+			case *readErr:
+				logTo(t.Logger, LogWarn, "server error", "error", string(oo.Payload))
+			case *readInfo:
+				t.updateInfo(d, (*ServerInfo)(oo))
 			}
 		}
 	}()
 
+	t.setConnection(c)
 	e = c.Run()
+	t.setConnection(nil)
 	close(dc)
 
+	// The feeder must be done with t.cc before Run can close it
+	<-fc
+
 	return e
 }
 
@@ -375,33 +671,71 @@ func (t *Client) Run(d Dialer, h Handshaker) error {
 	defer t.MarkStop()
 
 	var n net.Conn
+	var info *ServerInfo
 	var e error
+	var verbose bool
+
+	// Acknowledgements need to be matched to commands in verbose mode
+	if vh, ok := h.(VerboseHandshaker); ok {
+		verbose = vh.VerboseMode()
+	}
 
 	for {
 		n, e = d.Dial()
 		if e != nil {
 			// Error: dialer couldn't establish a connection
+			logTo(t.Logger, LogError, "dial failed", "error", e)
 			return e
 		}
 
-		n, e = h.Handshake(n)
+		var addr = n.RemoteAddr()
+
+		n, info, e = h.Handshake(n)
 		if e != nil {
 			// Error: handshake couldn't complete
+			logTo(t.Logger, LogError, "handshake failed", "addr", addr, "error", e)
 			return e
 		}
 
-		e = t.runConnection(n, sc)
+		// Later INFO may advertise headers, but only the handshake enables them
+		t.setNegotiatedHeaders(info != nil && info.Headers)
+
+		if info != nil {
+			previous := t.ServerInfo()
+			t.updateInfo(d, info)
+
+			logTo(t.Logger, LogInfo, "connected", "server_id", info.ServerId, "version", info.Version)
+
+			if previous != nil && previous.ServerId != info.ServerId {
+				logTo(t.Logger, LogWarn, "connected to another server",
+					"previous_server_id", previous.ServerId, "server_id", info.ServerId)
+
+				if t.ServerChanged != nil {
+					t.ServerChanged(previous, info)
+				}
+			}
+		} else {
+			logTo(t.Logger, LogInfo, "connected")
+		}
+
+		e = t.runConnection(d, n, verbose, sc)
 		if e == nil {
 			// No error: client was explicitly stopped
+			logTo(t.Logger, LogInfo, "stopped")
 			return nil
 		}
-	}
 
-	return nil
+		logTo(t.Logger, LogWarn, "connection lost, reconnecting", "error", e)
+		t.Metrics.reconnected()
+	}
 }
 
 func (t *Client) RunWithDefaults(addr string, user, pass string) error {
-	d := DefaultDialer(addr)
-	h := DefaultHandshaker(user, pass)
+	d := DefaultDialer(addr).(RetryingDialer)
+	d.Logger = t.Logger
+
+	h := DefaultHandshaker(user, pass).(Handshake)
+	h.Logger = t.Logger
+
 	return t.Run(d, h)
 }
@@ -1,10 +1,13 @@
 package nats
 
 import (
+	"bufio"
 	"github.com/cloudfoundry/gonats/test"
 	"net"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testClient struct {
@@ -19,6 +22,9 @@ type testClient struct {
 	// Channel to pass client side of the connection to Dialer
 	ncc chan net.Conn
 
+	// Channel to receive servers discovered by the Dialer, if set
+	dc chan []string
+
 	// Test server
 	s *test.TestServer
 
@@ -27,20 +33,57 @@ type testClient struct {
 }
 
 func (tc *testClient) Setup(t *testing.T) {
+	tc.SetupWith(t, NewClient(), EmptyHandshake)
+}
+
+func (tc *testClient) SetupWith(t *testing.T, c *Client, h Handshaker) {
 	tc.T = t
-	tc.c = NewClient()
+	tc.c = c
 	tc.ec = make(chan error, 1)
 	tc.ncc = make(chan net.Conn)
 
+	var d Dialer = DumbChannelDialer{tc.ncc}
+	if tc.dc != nil {
+		d = discoveringDialer{DumbChannelDialer{tc.ncc}, tc.dc}
+	}
+
 	tc.Add(1)
 	go func() {
-		tc.ec <- tc.c.Run(DumbChannelDialer{tc.ncc}, EmptyHandshake)
+		tc.ec <- tc.c.Run(d, h)
 		tc.Done()
 	}()
 
 	tc.ResetConnection()
 }
 
+// Dialer that passes discovered servers to a channel
+type discoveringDialer struct {
+	DumbChannelDialer
+	dc chan []string
+}
+
+func (d discoveringDialer) Discover(addrs []string) {
+	d.dc <- addrs
+}
+
+// Handshaker that passes server info from a channel
+type infoHandshake struct {
+	ic chan *ServerInfo
+}
+
+func (h infoHandshake) Handshake(n net.Conn) (net.Conn, *ServerInfo, error) {
+	return n, <-h.ic, nil
+}
+
+// Handshaker that only puts the client in verbose mode
+type verboseHandshake struct {
+	emptyHandshake
+}
+
+func (h verboseHandshake) VerboseMode() bool {
+	return true
+}
+
 func (tc *testClient) ResetConnection() {
 	// Close current test server, if any
 	if tc.s != nil {
@@ -86,6 +129,7 @@ func TestClientCloseInboxOnStop(t *testing.T) {
 
 func TestClientSubscriptionReceivesMessage(t *testing.T) {
 	var tc testClient
+	var rc = make(chan bool)
 
 	tc.Setup(t)
 
@@ -94,21 +138,28 @@ func TestClientSubscriptionReceivesMessage(t *testing.T) {
 		sub := tc.c.NewSubscription("subject")
 		sub.Subscribe()
 
-		m := <-sub.Inbox
-
-		expected := "payload"
-		actual := string(m.Payload)
+		m, ok := <-sub.Inbox
+		if !ok {
+			t.Errorf("Expected OK")
+		} else {
+			expected := "payload"
+			actual := string(m.Payload)
 
-		if actual != expected {
-			t.Errorf("Expected: %#v, got: %#v", expected, actual)
+			if actual != expected {
+				t.Errorf("Expected: %#v, got: %#v", expected, actual)
+			}
 		}
 
+		close(rc)
 		tc.Done()
 	}()
 
 	tc.s.AssertRead("SUB subject 1\r\n")
 	tc.s.AssertWrite("MSG subject 1 7\r\npayload\r\n")
 
+	// Don't stop before the message was delivered
+	<-rc
+
 	tc.Teardown()
 }
 
@@ -190,6 +241,7 @@ func TestClientSubscriptionWithMaximum(t *testing.T) {
 
 func TestClientSubscriptionReceivesMessageAfterReconnect(t *testing.T) {
 	var tc testClient
+	var rc = make(chan bool)
 
 	tc.Setup(t)
 
@@ -198,15 +250,19 @@ func TestClientSubscriptionReceivesMessageAfterReconnect(t *testing.T) {
 		sub := tc.c.NewSubscription("subject")
 		sub.Subscribe()
 
-		m := <-sub.Inbox
-
-		expected := "payload"
-		actual := string(m.Payload)
+		m, ok := <-sub.Inbox
+		if !ok {
+			t.Errorf("Expected OK")
+		} else {
+			expected := "payload"
+			actual := string(m.Payload)
 
-		if actual != expected {
-			t.Errorf("Expected: %#v, got: %#v", expected, actual)
+			if actual != expected {
+				t.Errorf("Expected: %#v, got: %#v", expected, actual)
+			}
 		}
 
+		close(rc)
 		tc.Done()
 	}()
 
@@ -217,11 +273,15 @@ func TestClientSubscriptionReceivesMessageAfterReconnect(t *testing.T) {
 	tc.s.AssertRead("SUB subject 1\r\n")
 	tc.s.AssertWrite("MSG subject 1 7\r\npayload\r\n")
 
+	// Don't stop before the message was delivered
+	<-rc
+
 	tc.Teardown()
 }
 
 func TestClientSubscriptionAdjustsMaximumAfterReconnect(t *testing.T) {
 	var tc testClient
+	var mc = make(chan bool, 2)
 
 	tc.Setup(t)
 
@@ -234,6 +294,7 @@ func TestClientSubscriptionAdjustsMaximumAfterReconnect(t *testing.T) {
 		var n = 0
 		for _ = range sub.Inbox {
 			n += 1
+			mc <- true
 		}
 
 		if n != 2 {
@@ -247,6 +308,9 @@ func TestClientSubscriptionAdjustsMaximumAfterReconnect(t *testing.T) {
 	tc.s.AssertRead("UNSUB 1 2\r\n")
 	tc.s.AssertWrite("MSG subject 1 2\r\nhi\r\n")
 
+	// Don't reconnect before the message was delivered
+	<-mc
+
 	tc.ResetConnection()
 
 	tc.s.AssertRead("SUB subject 1\r\n")
@@ -305,6 +369,7 @@ func TestClientRequest(t *testing.T) {
 
 func TestClientPublishAndConfirmSucceeds(t *testing.T) {
 	var tc testClient
+	var rc = make(chan bool)
 
 	tc.Setup(t)
 
@@ -315,6 +380,7 @@ func TestClientPublishAndConfirmSucceeds(t *testing.T) {
 			t.Error("Expected success")
 		}
 
+		close(rc)
 		tc.Done()
 	}()
 
@@ -322,6 +388,9 @@ func TestClientPublishAndConfirmSucceeds(t *testing.T) {
 	tc.s.AssertRead("PING\r\n")
 	tc.s.AssertWrite("PONG\r\n")
 
+	// Don't stop before the confirmation was received
+	<-rc
+
 	tc.Teardown()
 }
 
@@ -345,3 +414,637 @@ func TestClientPublishAndConfirmFails(t *testing.T) {
 
 	tc.Teardown()
 }
+
+func TestClientPublishAndConfirmVerboseSucceeds(t *testing.T) {
+	var tc testClient
+	var rc = make(chan bool)
+
+	tc.SetupWith(t, NewClient(), verboseHandshake{})
+
+	tc.Add(1)
+	go func() {
+		sub := tc.c.NewSubscription("subject")
+		sub.Subscribe()
+
+		ok := tc.c.PublishAndConfirm("subject", []byte("message"))
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		close(rc)
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+	tc.s.AssertWrite("+OK\r\n")
+	tc.s.AssertRead("PUB subject 7\r\nmessage\r\n")
+	tc.s.AssertWrite("+OK\r\n")
+
+	// Don't stop before the confirmation was received
+	<-rc
+
+	tc.Teardown()
+}
+
+func TestClientPublishAndConfirmVerboseFails(t *testing.T) {
+	var tc testClient
+	var rc = make(chan bool)
+
+	tc.SetupWith(t, NewClient(), verboseHandshake{})
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.PublishAndConfirm("subject", []byte("message"))
+		if ok {
+			t.Error("Expected failure")
+		}
+
+		close(rc)
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PUB subject 7\r\nmessage\r\n")
+	tc.s.AssertWrite("-ERR 'Invalid Subject'\r\n")
+
+	// Don't stop before the confirmation was received
+	<-rc
+
+	tc.Teardown()
+}
+
+func TestClientReconnectsWhenStale(t *testing.T) {
+	var tc testClient
+
+	c := NewClient()
+	c.PingInterval = 10 * time.Millisecond
+	c.MaxPingsOutstanding = 1
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.Add(1)
+	go func() {
+		sub := tc.c.NewSubscription("subject")
+		sub.Subscribe()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+
+	// Don't answer the keepalive, so the client gives up on this connection
+	tc.s.AssertRead("PING\r\n")
+
+	nc, ns := net.Pipe()
+	tc.ncc <- nc
+	tc.s = test.NewTestServer(t, ns)
+
+	// Keepalive continues on the new connection, so answer PINGs until the
+	// subscription is restored
+	r := bufio.NewReader(ns)
+	for {
+		line, e := r.ReadString('\n')
+		if e != nil {
+			t.Error(e)
+			break
+		}
+
+		if line == "PING\r\n" {
+			ns.Write([]byte("PONG\r\n"))
+			continue
+		}
+
+		if line != "SUB subject 1\r\n" {
+			t.Errorf("Expected: %#v, got: %#v", "SUB subject 1\r\n", line)
+		}
+
+		break
+	}
+
+	// Keep the new connection alive until the client is stopped
+	tc.Add(1)
+	go func() {
+		for {
+			line, e := r.ReadString('\n')
+			if e != nil {
+				break
+			}
+
+			if line == "PING\r\n" {
+				ns.Write([]byte("PONG\r\n"))
+			}
+		}
+
+		tc.Done()
+	}()
+
+	tc.Teardown()
+}
+
+func TestClientRTT(t *testing.T) {
+	var tc testClient
+	var rc = make(chan bool)
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		_, ok := tc.c.RTT()
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		if tc.c.EstimatedRTT() == 0 {
+			t.Error("Expected estimate")
+		}
+
+		close(rc)
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	// Don't stop before the round trip completed
+	<-rc
+
+	tc.Teardown()
+}
+
+func TestClientAsyncInfo(t *testing.T) {
+	var tc testClient
+
+	tc.dc = make(chan []string, 1)
+	tc.Setup(t)
+
+	tc.s.AssertWrite("INFO {\"server_id\":\"id\",\"connect_urls\":[\"a:1\",\"b:2\"]}\r\n")
+
+	addrs := <-tc.dc
+
+	expected := []string{"a:1", "b:2"}
+	if !reflect.DeepEqual(expected, addrs) {
+		t.Errorf("Expected: %#v, got: %#v", expected, addrs)
+	}
+
+	tc.c.infoLock.Lock()
+	if tc.c.info == nil || tc.c.info.ServerId != "id" {
+		t.Errorf("Expected server info to be kept")
+	}
+	tc.c.infoLock.Unlock()
+
+	tc.Teardown()
+}
+
+func TestClientAsyncInfoWithoutTopology(t *testing.T) {
+	var tc testClient
+
+	tc.dc = make(chan []string, 1)
+	tc.Setup(t)
+
+	tc.s.AssertWrite("INFO {\"server_id\":\"id\"}\r\n")
+
+	// Round trip to make sure the INFO was handled
+	tc.Add(1)
+	go func() {
+		tc.c.Ping()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	select {
+	case addrs := <-tc.dc:
+		t.Errorf("Expected no discovery, got: %#v", addrs)
+	default:
+	}
+
+	tc.Teardown()
+}
+
+func TestClientPublishWithHeader(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 1)
+
+	ic <- &ServerInfo{Headers: true}
+	tc.SetupWith(t, NewClient(), infoHandshake{ic})
+
+	tc.Add(1)
+	go func() {
+		h := Header{}
+		h.Set("Content-Type", "text/plain")
+
+		ok := tc.c.PublishWithHeader("subject", h, []byte("message"))
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("HPUB subject 38 45\r\nNATS/1.0\r\nContent-Type: text/plain\r\n\r\nmessage\r\n")
+
+	tc.Teardown()
+}
+
+func TestClientServerInfo(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 2)
+	var cc = make(chan [2]*ServerInfo, 1)
+
+	c := NewClient()
+	c.ServerChanged = func(previous, current *ServerInfo) {
+		cc <- [2]*ServerInfo{previous, current}
+	}
+
+	ic <- &ServerInfo{ServerId: "a"}
+	tc.SetupWith(t, c, infoHandshake{ic})
+
+	// Round trip to make sure the handshake completed
+	tc.Add(1)
+	go func() {
+		tc.c.Ping()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	if tc.c.ServerInfo().ServerId != "a" {
+		t.Errorf("Expected: %#v, got: %#v", "a", tc.c.ServerInfo().ServerId)
+	}
+
+	// Reconnect to another server
+	ic <- &ServerInfo{ServerId: "b"}
+	tc.ResetConnection()
+
+	changed := <-cc
+	if changed[0].ServerId != "a" || changed[1].ServerId != "b" {
+		t.Errorf("Unexpected change: %#v, %#v", changed[0], changed[1])
+	}
+
+	if tc.c.ServerInfo().ServerId != "b" {
+		t.Errorf("Expected: %#v, got: %#v", "b", tc.c.ServerInfo().ServerId)
+	}
+
+	tc.Teardown()
+}
+
+func TestClientAsyncInfoKeepsNegotiatedHeaders(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 1)
+
+	ic <- &ServerInfo{Headers: false}
+	tc.SetupWith(t, NewClient(), infoHandshake{ic})
+
+	tc.s.AssertWrite("INFO {\"server_id\":\"id\",\"headers\":true}\r\n")
+
+	test.WaitFor(t, time.Second, "async INFO", func() bool {
+		return tc.c.ServerInfo().ServerId == "id"
+	})
+
+	if tc.c.ServerInfo().Headers {
+		t.Errorf("Expected negotiated headers to be kept")
+	}
+
+	tc.Teardown()
+}
+
+func TestClientPublishWithHeaderUnsupported(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 1)
+
+	ic <- &ServerInfo{Headers: false}
+	tc.SetupWith(t, NewClient(), infoHandshake{ic})
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.PublishWithHeader("subject", Header{"A": {"1"}}, []byte("message"))
+		if ok {
+			t.Error("Expected failure")
+		}
+
+		tc.Done()
+	}()
+
+	tc.Teardown()
+}
+
+func TestClientPublishWithInvalidHeader(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 1)
+
+	ic <- &ServerInfo{Headers: true}
+	tc.SetupWith(t, NewClient(), infoHandshake{ic})
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.PublishWithHeader("subject", Header{"A": {"1\r\n"}}, []byte("message"))
+		if ok {
+			t.Error("Expected failure")
+		}
+
+		// The connection is still usable
+		ok = tc.c.Publish("subject", []byte("message"))
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PUB subject 7\r\nmessage\r\n")
+
+	tc.Teardown()
+}
+
+func TestClientPublishWithHeaderNotNegotiated(t *testing.T) {
+	var tc testClient
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.PublishWithHeader("subject", Header{"A": {"1"}}, []byte("message"))
+		if ok {
+			t.Error("Expected failure")
+		}
+
+		tc.Done()
+	}()
+
+	// The server advertising headers later doesn't enable them
+	tc.s.AssertWrite("INFO {\"server_id\":\"id\",\"headers\":true}\r\n")
+
+	tc.Teardown()
+}
+
+func TestClientLogsDroppedMessage(t *testing.T) {
+	var tc testClient
+	var tl testLogger
+
+	c := NewClient()
+	c.Logger = &tl
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.s.AssertWrite("MSG subject 1 2\r\nhi\r\n")
+
+	// Round trip so the message is handled first
+	tc.Add(1)
+	go func() {
+		tc.c.Ping()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	tc.Teardown()
+
+	// Messages are handled on their own goroutine
+	var found bool
+	for i := 0; i < 1000 && !found; i++ {
+		for _, m := range tl.Messages() {
+			if m == "dropped message without subscription" {
+				found = true
+			}
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if !found {
+		t.Errorf("Expected dropped message to be logged, got: %#v", tl.Messages())
+	}
+}
+
+// Tracer that starts every publish with the same context, and passes the
+// context of delivered messages to a channel
+type testTracer struct {
+	tc  TraceContext
+	dc  chan TraceContext
+	pcc chan TraceContext
+}
+
+func (tr testTracer) Publish(subject string, parent TraceContext) TraceContext {
+	if tr.pcc != nil {
+		tr.pcc <- parent
+	}
+
+	return tr.tc
+}
+
+func (tr testTracer) Deliver(subject string, tc TraceContext) {
+	tr.dc <- tc
+}
+
+func TestClientPublishTracedWithEnvelope(t *testing.T) {
+	var tc testClient
+	var pcc = make(chan TraceContext, 1)
+
+	parent := NewSpan(TraceContext{})
+
+	c := NewClient()
+	c.Tracer = testTracer{tc: mustParseTraceparent(t, testTraceparent), pcc: pcc}
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.PublishTraced("subject", parent, []byte("message"))
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		tc.Done()
+	}()
+
+	// The server isn't known to support headers
+	tc.s.AssertRead("PUB subject 77\r\n\x00traceparent " + testTraceparent + "\r\nmessage\r\n")
+
+	if p := <-pcc; p != parent {
+		t.Errorf("Expected parent %#v, got %#v", parent, p)
+	}
+
+	tc.Teardown()
+}
+
+func TestClientRequestTraced(t *testing.T) {
+	var tc testClient
+	var pcc = make(chan TraceContext, 1)
+
+	parent := NewSpan(TraceContext{})
+
+	c := NewClient()
+	c.Tracer = testTracer{tc: mustParseTraceparent(t, testTraceparent), pcc: pcc}
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.RequestTraced("subject", parent, []byte("message"), func(sub *Subscription) {})
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertMatch("SUB _INBOX\\.[0-9a-f]{26} 1\r\n")
+	tc.s.AssertMatch("PUB subject _INBOX\\.[0-9a-f]{26} 77\r\n\x00traceparent " + testTraceparent + "\r\nmessage\r\n")
+
+	if p := <-pcc; p != parent {
+		t.Errorf("Expected parent %#v, got %#v", parent, p)
+	}
+
+	tc.Teardown()
+}
+
+func TestClientPublishTracedWithHeader(t *testing.T) {
+	var tc testClient
+	var ic = make(chan *ServerInfo, 1)
+
+	ic <- &ServerInfo{ServerId: "a", Headers: true}
+
+	c := NewClient()
+	c.Tracer = testTracer{tc: mustParseTraceparent(t, testTraceparent)}
+
+	tc.SetupWith(t, c, infoHandshake{ic})
+
+	tc.Add(1)
+	go func() {
+		ok := tc.c.Publish("subject", []byte("message"))
+		if !ok {
+			t.Error("Expected success")
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("HPUB subject 82 89\r\nNATS/1.0\r\ntraceparent: " + testTraceparent + "\r\n\r\nmessage\r\n")
+
+	tc.Teardown()
+}
+
+func TestClientDeliversTraceContext(t *testing.T) {
+	var tc testClient
+	var dc = make(chan TraceContext, 1)
+	var mc = make(chan *readMessage, 1)
+
+	c := NewClient()
+	c.Tracer = testTracer{dc: dc}
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.Add(1)
+	go func() {
+		sub := tc.c.NewSubscription("subject")
+		sub.Subscribe()
+
+		mc <- <-sub.Inbox
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+	tc.s.AssertWrite("MSG subject 1 77\r\n\x00traceparent " + testTraceparent + "\r\nmessage\r\n")
+
+	expected := mustParseTraceparent(t, testTraceparent)
+
+	if got := <-dc; got != expected {
+		t.Errorf("Expected tracer to receive %#v, got %#v", expected, got)
+	}
+
+	// Don't stop before the message was delivered
+	m := <-mc
+
+	if m.Trace != expected || string(m.Payload) != "message" {
+		t.Errorf("Expected trace context and payload, got %#v", m)
+	}
+
+	tc.Teardown()
+}
+
+func mustParseTraceparent(t *testing.T, s string) TraceContext {
+	tc, e := ParseTraceparent(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return tc
+}
+
+func TestClientScriptedRequest(t *testing.T) {
+	var tc testClient
+
+	tc.Setup(t)
+
+	var sc = tc.s.Script()
+	var rc = make(chan string, 1)
+
+	tc.Add(1)
+	go func() {
+		tc.c.Request("subject", []byte("message"), func(sub *Subscription) {
+			m := <-sub.Inbox
+			sub.Unsubscribe()
+			rc <- string(m.Payload)
+		})
+
+		tc.Done()
+	}()
+
+	sub := sc.Expect("SUB", test.SubjectMatching(`^_INBOX\.[0-9a-f]{26}$`))
+	pub := sc.Expect("PUB", test.Subject("subject"), test.Payload("message"))
+
+	if sub != nil && pub != nil {
+		if pub.ReplyTo != sub.Subject {
+			t.Errorf("Expected reply to %s, got %s", sub.Subject, pub.ReplyTo)
+		}
+
+		sc.Send(test.Msg(sub.Subject, sub.Sid, "", "response"))
+		sc.Expect("UNSUB", test.Sid(sub.Sid))
+
+		if r := <-rc; r != "response" {
+			t.Errorf("Expected response, got %s", r)
+		}
+	}
+
+	tc.Teardown()
+}
+
+func TestClientScriptedPublishesInAnyOrder(t *testing.T) {
+	var tc testClient
+
+	tc.Setup(t)
+
+	var sc = tc.s.Script()
+
+	for _, m := range []string{"1", "2", "3"} {
+		tc.Add(1)
+		go func(m string) {
+			tc.c.Publish("subject."+m, []byte(m))
+			tc.Done()
+		}(m)
+	}
+
+	for _, m := range []string{"3", "1", "2"} {
+		sc.Expect("PUB", test.Subject("subject."+m), test.Payload(m))
+	}
+
+	sc.ExpectNothing(10 * time.Millisecond)
+
+	tc.Teardown()
+}
+
+func TestClientInboxesSeededFromClock(t *testing.T) {
+	a := NewClient()
+	a.Clock = test.NewFakeClock()
+
+	b := NewClient()
+	b.Clock = test.NewFakeClock()
+
+	for i := 0; i < 3; i++ {
+		if x, y := a.createInbox(), b.createInbox(); x != y {
+			t.Errorf("Expected same inboxes, got %s and %s", x, y)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package nats
+
+import (
+	"time"
+)
+
+// Source of time for everything the package waits on, so tests can replace
+// it with a fake one. Uses only types from the standard library, so fakes
+// don't need to import this package.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+
+	// Channel receiving the time once d has passed, and a function stopping
+	// it that returns false if it already fired
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+
+	// Channel receiving the time every d, and a function stopping it
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// Clock backed by the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	var t = time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+func (systemClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	var t = time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+
+	return c
+}
@@ -0,0 +1,158 @@
+package nats
+
+import (
+	"errors"
+	"github.com/cloudfoundry/gonats/test"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection adapted for the client side conformance suite
+type conformanceConnection struct {
+	c  *Connection
+	ec chan error
+
+	// Messages, buffered so the connection never waits for the suite
+	mc chan *readMessage
+}
+
+func newConformanceConnection(n net.Conn) test.ConformanceClient {
+	var cc = new(conformanceConnection)
+
+	cc.c = NewConnection(n)
+	cc.ec = make(chan error, 1)
+	cc.mc = make(chan *readMessage, 16)
+
+	go func() {
+		cc.ec <- cc.c.Run()
+	}()
+
+	go func() {
+		for o := range cc.c.oc {
+			if m, ok := o.(*readMessage); ok {
+				cc.mc <- m
+			}
+		}
+
+		close(cc.mc)
+	}()
+
+	return cc
+}
+
+func (cc *conformanceConnection) write(o writeObject) error {
+	if !cc.c.Write(o) {
+		return errors.New("write failed")
+	}
+
+	return nil
+}
+
+func (cc *conformanceConnection) Subscribe(subject, queue string, sid int) error {
+	return cc.write(&writeSubscribe{Sid: uint(sid), Subject: subject, Queue: queue})
+}
+
+func (cc *conformanceConnection) Unsubscribe(sid int, max int) error {
+	return cc.write(&writeUnsubscribe{Sid: uint(sid), Maximum: uint(max)})
+}
+
+func (cc *conformanceConnection) Publish(subject, reply string, payload []byte) error {
+	return cc.write(&writePublish{Subject: subject, ReplyTo: reply, Message: payload})
+}
+
+func (cc *conformanceConnection) Ping() error {
+	if !cc.c.Ping() {
+		return errors.New("no PONG")
+	}
+
+	return nil
+}
+
+func (cc *conformanceConnection) Next(d time.Duration) (*test.Delivery, error) {
+	select {
+	case m, ok := <-cc.mc:
+		if !ok {
+			return nil, test.ErrNoDelivery
+		}
+
+		return &test.Delivery{
+			Subject: string(m.Subscription),
+			Sid:     int(m.SubscriptionId),
+			ReplyTo: string(m.ReplyTo),
+			Payload: m.Payload,
+		}, nil
+	case <-time.After(d):
+		return nil, test.ErrNoDelivery
+	}
+}
+
+func (cc *conformanceConnection) Close() error {
+	cc.c.Stop()
+
+	return <-cc.ec
+}
+
+func TestConformanceConnection(t *testing.T) {
+	test.RunClientConformance(t, newConformanceConnection)
+}
+
+func TestConformanceServerOverPipe(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	test.RunServerConformance(t, func() (net.Conn, error) {
+		return s.Pipe(), nil
+	})
+}
+
+func TestConformanceServerOverLoopback(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	addr, e := s.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	test.RunServerConformance(t, func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+}
+
+// A client and server that both pass the suites also work with each other
+func TestConformanceConnectionAgainstServer(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	var cc = newConformanceConnection(s.Pipe()).(*conformanceConnection)
+	defer cc.Close()
+
+	var payloads = [][]byte{{}, []byte("\r\nMSG foo 1 2\r\nhi\r\n"), []byte("x")}
+
+	cc.write(&writeConnect{Verbose: false})
+	cc.Subscribe("foo", "", 1)
+	cc.Unsubscribe(1, len(payloads))
+	cc.Subscribe("bar", "", 2)
+
+	for _, p := range payloads {
+		cc.Publish("foo", "", p)
+	}
+
+	// Past the maximum, so not delivered
+	cc.Publish("foo", "", []byte("dropped"))
+
+	// Delivered after the dropped message would have been
+	cc.Publish("bar", "", []byte("barrier"))
+
+	if e := cc.Ping(); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, p := range append(payloads, []byte("barrier")) {
+		d, e := cc.Next(test.ConformanceTimeout)
+		if e != nil || string(d.Payload) != string(p) {
+			t.Errorf("Expected %q, got %#v, %v", p, d, e)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package nats
+
+// Publishing side of a client
+type Publisher interface {
+	Publish(s string, m []byte) bool
+	PublishAndConfirm(s string, m []byte) bool
+	PublishWithHeader(s string, h Header, m []byte) bool
+	PublishWithReply(s string, r string, m []byte) bool
+}
+
+// Subscribing side of a client. Subscriptions are configured and then
+// subscribed through the Subscription itself.
+type Subscriber interface {
+	NewSubscription(sub string) *Subscription
+}
+
+type Requester interface {
+	Request(s string, m []byte, f func(*Subscription)) bool
+}
+
+// What code using a client depends on, implemented by Client and by
+// FakeClient for tests without a server
+type Conn interface {
+	Publisher
+	Subscriber
+	Requester
+}
@@ -2,9 +2,16 @@ package nats
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"net/textproto"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStaleConnection = errors.New("nats: stale connection")
 )
 
 type Connection struct {
@@ -29,6 +36,33 @@ type Connection struct {
 
 	// Channel for receiving messages
 	oc chan readObject
+
+	// Whether the server acknowledges every command
+	verbose bool
+
+	// Channels waiting for acknowledgements, in the order the commands were
+	// written. A nil entry is an acknowledgement nobody waits for.
+	aq      []chan bool
+	aLock   sync.Mutex
+	aClosed bool
+
+	// Interval between keepalive PINGs, and the number of them that may go
+	// unanswered before the connection is considered stale
+	pingInterval time.Duration
+	maxPingsOut  uint
+
+	// Keepalive PINGs waiting for their PONG
+	pingsOut int32
+
+	// Smoothed round trip time, updated by every RTT measurement
+	srtt    time.Duration
+	rttLock sync.Mutex
+
+	// Called with every RTT measurement, if set
+	rttHandler func(time.Duration)
+
+	// Times RTT measurements and keepalive intervals
+	clock Clock
 }
 
 func NewConnection(rw io.ReadWriteCloser) *Connection {
@@ -44,9 +78,99 @@ func NewConnection(rw io.ReadWriteCloser) *Connection {
 	c.pc = make(chan bool)
 	c.oc = make(chan readObject)
 
+	c.clock = SystemClock
+
 	return c
 }
 
+// Set whether the server acknowledges every command; call before Run
+func (c *Connection) SetVerbose(v bool) {
+	c.verbose = v
+}
+
+// Send a PING every interval, and consider the connection stale when max of
+// them are waiting for a PONG at the next interval. A zero interval disables
+// keepalive, a zero max is treated as one. Call before Run.
+func (c *Connection) SetKeepAlive(interval time.Duration, max uint) {
+	if max == 0 {
+		max = 1
+	}
+
+	c.pingInterval = interval
+	c.maxPingsOut = max
+}
+
+// Call f with every RTT measurement, including keepalive PINGs; call before
+// Run
+func (c *Connection) SetRTTHandler(f func(time.Duration)) {
+	c.rttHandler = f
+}
+
+// Use clock for RTT measurements and keepalive; call before Run
+func (c *Connection) SetClock(clock Clock) {
+	c.clock = clockOrSystem(clock)
+}
+
+// Whether the server acknowledges this command in verbose mode
+func acknowledged(o writeObject) bool {
+	switch o.(type) {
+	case *writePublish, *writeSubscribe, *writeUnsubscribe:
+		return true
+	}
+
+	return false
+}
+
+// Expects to be called when the writer lock is held, so acknowledgements are
+// queued in the order the commands are written
+func (c *Connection) expectAck(ac chan bool) {
+	c.aLock.Lock()
+	defer c.aLock.Unlock()
+
+	if c.aClosed {
+		if ac != nil {
+			close(ac)
+		}
+		return
+	}
+
+	c.aq = append(c.aq, ac)
+}
+
+func (c *Connection) ack(ok bool) {
+	var ac chan bool
+
+	c.aLock.Lock()
+
+	if len(c.aq) == 0 {
+		c.aLock.Unlock()
+		return
+	}
+
+	ac = c.aq[0]
+	c.aq = c.aq[1:]
+
+	c.aLock.Unlock()
+
+	if ac != nil {
+		ac <- ok
+	}
+}
+
+func (c *Connection) closeAcks() {
+	c.aLock.Lock()
+	defer c.aLock.Unlock()
+
+	for _, ac := range c.aq {
+		if ac != nil {
+			close(ac)
+		}
+	}
+
+	c.aq = nil
+	c.aClosed = true
+}
+
 func (c *Connection) setReadError(e error) {
 	if c.re == nil {
 		c.re = e
@@ -93,8 +217,16 @@ func (c *Connection) read(r *bufio.Reader) (readObject, error) {
 }
 
 func (c *Connection) write(w *bufio.Writer, o writeObject) error {
+	return c.writeWithAck(w, o, nil)
+}
+
+func (c *Connection) writeWithAck(w *bufio.Writer, o writeObject, ac chan bool) error {
 	var e error
 
+	if c.verbose && acknowledged(o) {
+		c.expectAck(ac)
+	}
+
 	e = write(w, o)
 	if e != nil {
 		c.setWriteError(e)
@@ -138,6 +270,44 @@ func (c *Connection) Ping() bool {
 	return c.pingAndWaitForPong(w)
 }
 
+// Measure the duration of a PING/PONG round trip
+func (c *Connection) RTT() (time.Duration, bool) {
+	var start = c.clock.Now()
+
+	if !c.Ping() {
+		return 0, false
+	}
+
+	var rtt = c.clock.Now().Sub(start)
+
+	c.rttLock.Lock()
+
+	// Same smoothing as TCP: the first sample is taken as is, every next one
+	// moves the estimate by an eighth of the difference
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt += (rtt - c.srtt) / 8
+	}
+
+	c.rttLock.Unlock()
+
+	if c.rttHandler != nil {
+		c.rttHandler(rtt)
+	}
+
+	return rtt, true
+}
+
+// Smoothed round trip time of the RTT measurements and keepalive PINGs so
+// far, zero if there were none
+func (c *Connection) EstimatedRTT() time.Duration {
+	c.rttLock.Lock()
+	defer c.rttLock.Unlock()
+
+	return c.srtt
+}
+
 func (c *Connection) WriteChannel(oc chan writeObject) bool {
 	var w *bufio.Writer
 	var e error
@@ -184,6 +354,57 @@ func (c *Connection) WriteAndPing(o writeObject) bool {
 	return c.pingAndWaitForPong(w)
 }
 
+// Write object and wait for the server to confirm it was received. In verbose
+// mode this is the acknowledgement of the command itself, otherwise a PING
+// round trip.
+func (c *Connection) WriteAndConfirm(o writeObject) bool {
+	var w *bufio.Writer
+	var e error
+
+	if !c.verbose || !acknowledged(o) {
+		return c.WriteAndPing(o)
+	}
+
+	// Buffered so the reader never blocks on delivering the acknowledgement
+	var ac = make(chan bool, 1)
+
+	w = c.acquireWriter()
+	e = c.writeWithAck(w, o, ac)
+	c.releaseWriter()
+
+	if e != nil {
+		return false
+	}
+
+	ok := <-ac
+	return ok
+}
+
+func (c *Connection) keepAlive(kc chan bool, ec chan error) {
+	tc, stop := c.clock.NewTicker(c.pingInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-tc:
+			if uint(atomic.LoadInt32(&c.pingsOut)) >= c.maxPingsOut {
+				ec <- ErrStaleConnection
+				return
+			}
+
+			// PONGs are matched to PINGs by the pipeline in Ping
+			atomic.AddInt32(&c.pingsOut, 1)
+			go func() {
+				if _, ok := c.RTT(); ok {
+					atomic.AddInt32(&c.pingsOut, -1)
+				}
+			}()
+		case <-kc:
+			return
+		}
+	}
+}
+
 func (c *Connection) Run() error {
 	var r *bufio.Reader
 	var rc chan readObject
@@ -219,6 +440,16 @@ func (c *Connection) Run() error {
 		}
 	}()
 
+	// Keepalive runs until kc is closed, and reports staleness on kec
+	var kc = make(chan bool)
+	var kec = make(chan error, 1)
+
+	if c.pingInterval > 0 {
+		go c.keepAlive(kc, kec)
+	}
+
+	defer close(kc)
+
 	var stop bool
 	var e error
 	var ok bool
@@ -236,6 +467,8 @@ func (c *Connection) Run() error {
 			stop = true
 		case e = <-c.wec:
 			stop = true
+		case e = <-kec:
+			stop = true
 		case o, ok = <-rc:
 			if ok {
 				switch o.(type) {
@@ -245,6 +478,14 @@ func (c *Connection) Run() error {
 					}()
 				case *readPong:
 					c.pc <- true
+				case *readOk:
+					c.ack(true)
+				case *readErr:
+					if c.verbose && o.(*readErr).answersCommand() {
+						c.ack(false)
+					}
+
+					c.oc <- o
 				default:
 					c.oc <- o
 				}
@@ -258,6 +499,9 @@ func (c *Connection) Run() error {
 	// Can't receive more PONGs
 	close(c.pc)
 
+	// Can't receive more acknowledgements
+	c.closeAcks()
+
 	// Can't receive more messages
 	close(c.oc)
 
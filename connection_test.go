@@ -6,6 +6,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testConnection struct {
@@ -21,6 +22,12 @@ type testConnection struct {
 	// Channel to receive the return value of c.Run()
 	ec chan error
 
+	// Optional configuration of the test connection before it runs
+	configure func(c *Connection)
+
+	// Optional faults on the client side of the pipe
+	faults func(f *test.FaultConn)
+
 	// WaitGroup to join goroutines after every test
 	sync.WaitGroup
 }
@@ -28,7 +35,18 @@ type testConnection struct {
 func (tc *testConnection) Setup(t *testing.T) {
 	tc.nc, tc.ns = net.Pipe()
 	tc.s = test.NewTestServer(t, tc.ns)
+
+	if tc.faults != nil {
+		f := test.NewFaultConn(tc.nc)
+		tc.faults(f)
+		tc.nc = f
+	}
+
 	tc.c = NewConnection(tc.nc)
+	if tc.configure != nil {
+		tc.configure(tc.c)
+	}
+
 	tc.ec = make(chan error, 1)
 
 	tc.Add(1)
@@ -87,6 +105,64 @@ func TestConnectionReturnErrorOnError(t *testing.T) {
 	tc.Teardown()
 }
 
+func TestConnectionReturnReadFault(t *testing.T) {
+	var tc testConnection
+
+	tc.faults = func(f *test.FaultConn) {
+		f.FailReadAfter(0, nil)
+	}
+
+	tc.Setup(t)
+
+	e := <-tc.ec
+	if e != test.ErrInjectedFault {
+		t.Errorf("Expected: %#v, got: %#v", test.ErrInjectedFault, e)
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionReturnShortWrite(t *testing.T) {
+	var tc testConnection
+
+	tc.faults = func(f *test.FaultConn) {
+		f.SetShortWrites(2)
+	}
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.c.Write(&writePing{})
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PI")
+
+	e := <-tc.ec
+	if e != io.ErrShortWrite {
+		t.Errorf("Expected: %#v, got: %#v", io.ErrShortWrite, e)
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionFragmentedReads(t *testing.T) {
+	var tc testConnection
+
+	tc.faults = func(f *test.FaultConn) {
+		f.SetReadChunk(1)
+	}
+
+	tc.Setup(t)
+
+	tc.s.AssertWrite("PING\r\nPING\r\n")
+	tc.s.AssertRead("PONG\r\n")
+	tc.s.AssertRead("PONG\r\n")
+
+	tc.Teardown()
+}
+
 func TestConnectionPongOnPing(t *testing.T) {
 	var tc testConnection
 
@@ -159,3 +235,277 @@ func TestConnectionPingWhenDisconnectedMidway(t *testing.T) {
 
 	tc.Teardown()
 }
+
+func TestConnectionWriteAndConfirmVerbose(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetVerbose(true)
+	}
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.s.AssertRead("SUB subject 1\r\n")
+		tc.s.AssertRead("PUB subject 2\r\nhi\r\n")
+		tc.s.AssertWrite("+OK\r\n")
+		tc.s.AssertWrite("+OK\r\n")
+		tc.Done()
+	}()
+
+	tc.c.Write(&writeSubscribe{Sid: 1, Subject: "subject"})
+
+	var ok bool = tc.c.WriteAndConfirm(&writePublish{Subject: "subject", Message: []byte("hi")})
+	if !ok {
+		t.Errorf("Expected OK")
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionWriteAndConfirmVerboseAsyncError(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetVerbose(true)
+	}
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.s.AssertRead("PUB subject 1\r\na\r\n")
+		tc.s.AssertRead("PUB subject 1\r\nb\r\n")
+		tc.s.AssertWrite("+OK\r\n")
+		tc.s.AssertWrite("-ERR 'Slow Consumer'\r\n")
+		tc.s.AssertWrite("+OK\r\n")
+		tc.Done()
+	}()
+
+	// The unsolicited error is passed on instead of failing the second PUB
+	tc.Add(1)
+	go func() {
+		o := <-tc.c.oc
+		if e, ok := o.(*readErr); !ok || string(e.Payload) != "'Slow Consumer'" {
+			t.Errorf("Expected slow consumer error, got %#v", o)
+		}
+		tc.Done()
+	}()
+
+	tc.c.Write(&writePublish{Subject: "subject", Message: []byte("a")})
+
+	var ok bool = tc.c.WriteAndConfirm(&writePublish{Subject: "subject", Message: []byte("b")})
+	if !ok {
+		t.Errorf("Expected OK")
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionWriteAndConfirmVerboseWhenDisconnected(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetVerbose(true)
+	}
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.s.AssertRead("PUB subject 2\r\nhi\r\n")
+		tc.s.Close()
+		tc.Done()
+	}()
+
+	var ok bool = tc.c.WriteAndConfirm(&writePublish{Subject: "subject", Message: []byte("hi")})
+	if ok {
+		t.Errorf("Expected not OK")
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionKeepAlive(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetKeepAlive(time.Millisecond, 1000)
+	}
+
+	tc.Setup(t)
+
+	for i := 0; i < 5; i++ {
+		tc.s.AssertRead("PING\r\n")
+		tc.s.AssertWrite("PONG\r\n")
+	}
+
+	tc.Teardown()
+
+	e := <-tc.ec
+	if e != nil {
+		t.Error(e)
+	}
+}
+
+func TestConnectionKeepAliveStale(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetKeepAlive(time.Millisecond, 2)
+	}
+
+	tc.Setup(t)
+
+	// Read PINGs, but never answer
+	tc.Add(1)
+	go func() {
+		var buf = make([]byte, 64)
+
+		for {
+			if _, e := tc.s.Conn.Read(buf); e != nil {
+				break
+			}
+		}
+
+		tc.Done()
+	}()
+
+	e := <-tc.ec
+	if e != ErrStaleConnection {
+		t.Errorf("Expected: %#v, got: %#v", ErrStaleConnection, e)
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionKeepAliveStaleOnClock(t *testing.T) {
+	var tc testConnection
+
+	fc := test.NewFakeClock()
+
+	tc.configure = func(c *Connection) {
+		c.SetClock(fc)
+		c.SetKeepAlive(time.Minute, 1)
+	}
+
+	tc.Setup(t)
+
+	// First interval sends a PING, which is never answered
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	tc.s.AssertRead("PING\r\n")
+
+	select {
+	case e := <-tc.ec:
+		t.Errorf("Expected connection to be running, got %#v", e)
+	default:
+	}
+
+	// Next interval finds it still outstanding
+	fc.Advance(time.Minute)
+
+	e := <-tc.ec
+	if e != ErrStaleConnection {
+		t.Errorf("Expected: %#v, got: %#v", ErrStaleConnection, e)
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionKeepAliveBlackholed(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetKeepAlive(time.Millisecond, 2)
+	}
+
+	// PINGs never arrive, and nothing comes back
+	tc.faults = func(f *test.FaultConn) {
+		f.Blackhole()
+	}
+
+	tc.Setup(t)
+
+	e := <-tc.ec
+	if e != ErrStaleConnection {
+		t.Errorf("Expected: %#v, got: %#v", ErrStaleConnection, e)
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionRTT(t *testing.T) {
+	var tc testConnection
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.s.AssertRead("PING\r\n")
+		time.Sleep(time.Millisecond)
+		tc.s.AssertWrite("PONG\r\n")
+		tc.Done()
+	}()
+
+	rtt, ok := tc.c.RTT()
+	if !ok {
+		t.Errorf("Expected OK")
+	}
+
+	if rtt < time.Millisecond {
+		t.Errorf("Expected at least 1ms, got: %s", rtt)
+	}
+
+	if tc.c.EstimatedRTT() != rtt {
+		t.Errorf("Expected: %s, got: %s", rtt, tc.c.EstimatedRTT())
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionRTTWhenDisconnected(t *testing.T) {
+	var tc testConnection
+
+	tc.Setup(t)
+
+	tc.Add(1)
+	go func() {
+		tc.s.Close()
+		tc.Done()
+	}()
+
+	_, ok := tc.c.RTT()
+	if ok {
+		t.Errorf("Expected not OK")
+	}
+
+	tc.Teardown()
+}
+
+func TestConnectionKeepAliveUpdatesEstimatedRTT(t *testing.T) {
+	var tc testConnection
+
+	tc.configure = func(c *Connection) {
+		c.SetKeepAlive(time.Millisecond, 1000)
+	}
+
+	tc.Setup(t)
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	// The estimate is updated right after the PONG is handled
+	var rtt time.Duration
+	for i := 0; i < 1000 && rtt == 0; i++ {
+		rtt = tc.c.EstimatedRTT()
+		time.Sleep(time.Millisecond)
+	}
+
+	if rtt == 0 {
+		t.Errorf("Expected estimate")
+	}
+
+	tc.Teardown()
+}
@@ -2,6 +2,8 @@ package nats
 
 import (
 	"net"
+	"net/url"
+	"sync"
 	"time"
 )
 
@@ -9,6 +11,94 @@ type Dialer interface {
 	Dial() (net.Conn, error)
 }
 
+// Implemented by dialers that can use servers advertised by the cluster
+type DiscoveringDialer interface {
+	Dialer
+
+	// Replace the set of servers learned from the cluster
+	Discover(addrs []string)
+}
+
+// Set of servers to connect to: the ones configured up front, and the ones
+// learned from the cluster. Learned servers come and go as the cluster
+// changes, configured servers stay.
+type ServerPool struct {
+	sync.Mutex
+
+	configured []string
+	discovered []string
+
+	// Index of the next server to try
+	i int
+}
+
+func NewServerPool(addrs ...string) *ServerPool {
+	var p = new(ServerPool)
+
+	p.configured = append(p.configured, addrs...)
+
+	return p
+}
+
+// Expects to be called when the lock is held
+func (p *ServerPool) addrs() []string {
+	var a = make([]string, 0, len(p.configured)+len(p.discovered))
+
+	a = append(a, p.configured...)
+	a = append(a, p.discovered...)
+
+	return a
+}
+
+func (p *ServerPool) Addrs() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.addrs()
+}
+
+// Address to try next, rotating through all servers in the pool
+func (p *ServerPool) Next() string {
+	p.Lock()
+	defer p.Unlock()
+
+	var a = p.addrs()
+	if len(a) == 0 {
+		return ""
+	}
+
+	if p.i >= len(a) {
+		p.i = 0
+	}
+
+	var addr = a[p.i]
+	p.i++
+
+	return addr
+}
+
+func (p *ServerPool) SetDiscovered(addrs []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	var seen = make(map[string]bool)
+
+	for _, addr := range p.configured {
+		seen[addr] = true
+	}
+
+	p.discovered = nil
+
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+
+		seen[addr] = true
+		p.discovered = append(p.discovered, addr)
+	}
+}
+
 type DumbDialer struct {
 	Conn net.Conn
 }
@@ -25,18 +115,66 @@ func (d DumbChannelDialer) Dial() (net.Conn, error) {
 	return <-d.ncc, nil
 }
 
+// Connection that remembers the host it was dialed with, so TLS can verify
+// the server certificate against it rather than the resolved address
+type dialedConn struct {
+	net.Conn
+	host string
+}
+
+// Addresses are host:port, or URLs for DefaultWebSocketDialer
+func newDialedConn(n net.Conn, addr string) *dialedConn {
+	var host = addr
+
+	if u, e := url.Parse(addr); e == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if h, _, e := net.SplitHostPort(addr); e == nil {
+		host = h
+	}
+
+	return &dialedConn{n, host}
+}
+
+func (c *dialedConn) DialedHost() string {
+	return c.host
+}
+
 type RetryingDialer struct {
 	// The dialer
 	f func(addr string) (net.Conn, error)
 
-	// The sleeper
+	// The sleeper, backing off on Clock if nil
 	s func(i uint)
 
 	// Address to connect to
 	Addr string
 
+	// Servers to rotate through instead of Addr, if set
+	Pool *ServerPool
+
 	// Maximum number of connection attempts
 	MaxAttempts uint
+
+	// Where failed attempts are reported, if set
+	Logger Logger
+
+	// Source of time for backing off between attempts, SystemClock if nil
+	Clock Clock
+}
+
+func (d RetryingDialer) addr() string {
+	if d.Pool != nil {
+		return d.Pool.Next()
+	}
+
+	return d.Addr
+}
+
+// Servers are only learned when dialing from a pool
+func (d RetryingDialer) Discover(addrs []string) {
+	if d.Pool != nil {
+		d.Pool.SetDiscovered(addrs)
+	}
 }
 
 func (d RetryingDialer) Dial() (net.Conn, error) {
@@ -49,42 +187,69 @@ func (d RetryingDialer) Dial() (net.Conn, error) {
 			break
 		}
 
-		n, e = d.f(d.Addr)
+		var addr = d.addr()
+
+		n, e = d.f(addr)
 		if n != nil {
-			return n, nil
+			logTo(d.Logger, LogDebug, "dialed", "addr", addr)
+			return newDialedConn(n, addr), nil
 		}
 
-		d.s(i)
+		logTo(d.Logger, LogWarn, "dial failed", "addr", addr, "attempt", i+1, "error", e)
+
+		if d.s != nil {
+			d.s(i)
+		} else {
+			clockOrSystem(d.Clock).Sleep(backoff(i))
+		}
 	}
 
 	if e == nil {
 		panic("expected an error")
 	}
 
+	logTo(d.Logger, LogError, "giving up dialing", "attempts", i, "error", e)
+
 	return nil, e
 }
 
 func DefaultDialer(addr string) Dialer {
+	var d = defaultRetryingDialer()
+
+	d.Addr = addr
+
+	return d
+}
+
+// Dial the servers of a cluster in turn, and also the ones the cluster
+// advertises once connected
+func DefaultClusterDialer(addrs ...string) Dialer {
+	var d = defaultRetryingDialer()
+
+	d.Pool = NewServerPool(addrs...)
+
+	return d
+}
+
+func defaultRetryingDialer() RetryingDialer {
 	var d RetryingDialer
 
 	d.f = func(addr string) (net.Conn, error) {
 		return net.Dial("tcp", addr)
 	}
 
-	d.s = func(i uint) {
-		var exp uint = i + 3
-		if exp > 12 {
-			exp = 12
-		}
-
-		// Sleep between 8ms and 4096ms
-		time.Sleep((1 << exp) * time.Millisecond)
-	}
-
-	d.Addr = addr
-
 	// Retry 10 times
 	d.MaxAttempts = 10
 
 	return d
 }
+
+// Time to wait after failed attempt i, between 8ms and 4096ms
+func backoff(i uint) time.Duration {
+	var exp uint = i + 3
+	if exp > 12 {
+		exp = 12
+	}
+
+	return (1 << exp) * time.Millisecond
+}
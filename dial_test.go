@@ -2,8 +2,11 @@ package nats
 
 import (
 	"fmt"
+	"github.com/cloudfoundry/gonats/test"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 var ErrWhatever = fmt.Errorf("whatever")
@@ -37,6 +40,45 @@ func TestDialMaxAttempts(t *testing.T) {
 	}
 }
 
+func TestDialBacksOffOnClock(t *testing.T) {
+	d := DefaultDialer("address").(RetryingDialer)
+
+	fc := test.NewFakeClock()
+	start := fc.Now()
+
+	var attempts []time.Duration
+
+	// Fail every time, noting when
+	d.f = func(addr string) (net.Conn, error) {
+		attempts = append(attempts, fc.Now().Sub(start))
+		return nil, ErrWhatever
+	}
+
+	d.Clock = fc
+	d.MaxAttempts = 4
+
+	var ec = make(chan error)
+	go func() {
+		_, e := d.Dial()
+		ec <- e
+	}()
+
+	// Doubling from 8ms
+	for _, b := range []time.Duration{8, 16, 32, 64} {
+		fc.BlockUntil(1)
+		fc.Advance(b * time.Millisecond)
+	}
+
+	if e := <-ec; e != ErrWhatever {
+		t.Errorf("Expected: %#v, got: %#v", ErrWhatever, e)
+	}
+
+	expected := []time.Duration{0, 8 * time.Millisecond, 24 * time.Millisecond, 56 * time.Millisecond}
+	if !reflect.DeepEqual(expected, attempts) {
+		t.Errorf("Expected: %v, got: %v", expected, attempts)
+	}
+}
+
 func TestDialSuccess(t *testing.T) {
 	d := DefaultDialer("address").(RetryingDialer)
 
@@ -46,9 +88,120 @@ func TestDialSuccess(t *testing.T) {
 		return n, nil
 	}
 
-	_, e := d.Dial()
+	n, e := d.Dial()
 	if e != nil {
 		t.Errorf("Error: %#v", e)
 		return
 	}
+
+	// Remembers the host for TLS
+	if dh, ok := n.(DialedHoster); !ok || dh.DialedHost() != "address" {
+		t.Errorf("Expected the dialed host, got: %#v", n)
+	}
+}
+
+func TestServerPoolRotates(t *testing.T) {
+	p := NewServerPool("a:1", "b:2")
+
+	var actual []string
+	for i := 0; i < 3; i++ {
+		actual = append(actual, p.Next())
+	}
+
+	expected := []string{"a:1", "b:2", "a:1"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected: %#v, got: %#v", expected, actual)
+	}
+}
+
+func TestServerPoolDiscovered(t *testing.T) {
+	p := NewServerPool("a:1")
+
+	p.SetDiscovered([]string{"a:1", "b:2", "c:3"})
+
+	expected := []string{"a:1", "b:2", "c:3"}
+	if !reflect.DeepEqual(expected, p.Addrs()) {
+		t.Errorf("Expected: %#v, got: %#v", expected, p.Addrs())
+	}
+
+	// Servers that disappear from the cluster are removed, configured ones stay
+	p.SetDiscovered([]string{"c:3"})
+
+	expected = []string{"a:1", "c:3"}
+	if !reflect.DeepEqual(expected, p.Addrs()) {
+		t.Errorf("Expected: %#v, got: %#v", expected, p.Addrs())
+	}
+
+	p.SetDiscovered([]string{})
+
+	expected = []string{"a:1"}
+	if !reflect.DeepEqual(expected, p.Addrs()) {
+		t.Errorf("Expected: %#v, got: %#v", expected, p.Addrs())
+	}
+}
+
+func TestDialFromPool(t *testing.T) {
+	d := DefaultClusterDialer("a:1").(RetryingDialer)
+
+	var addrs []string
+
+	// Fail every time
+	d.f = func(addr string) (net.Conn, error) {
+		addrs = append(addrs, addr)
+		return nil, ErrWhatever
+	}
+
+	// Don't sleep
+	d.s = func(i uint) {
+	}
+
+	d.MaxAttempts = 3
+	d.Discover([]string{"b:2"})
+
+	d.Dial()
+
+	expected := []string{"a:1", "b:2", "a:1"}
+	if !reflect.DeepEqual(expected, addrs) {
+		t.Errorf("Expected: %#v, got: %#v", expected, addrs)
+	}
+}
+
+func TestDialLogsFailures(t *testing.T) {
+	var tl testLogger
+
+	d := DefaultDialer("address").(RetryingDialer)
+
+	// Fail every time
+	d.f = func(addr string) (net.Conn, error) {
+		return nil, ErrWhatever
+	}
+
+	// Don't sleep
+	d.s = func(i uint) {
+	}
+
+	d.MaxAttempts = 2
+	d.Logger = &tl
+
+	d.Dial()
+
+	expected := []string{"dial failed", "dial failed", "giving up dialing"}
+	if !reflect.DeepEqual(expected, tl.Messages()) {
+		t.Errorf("Expected: %#v, got: %#v", expected, tl.Messages())
+	}
+}
+
+func TestDialedConnHost(t *testing.T) {
+	for addr, host := range map[string]string{
+		"nats.test:4222":       "nats.test",
+		"127.0.0.1:4222":       "127.0.0.1",
+		"[::1]:4222":           "::1",
+		"localhost:4222":       "localhost",
+		"wss://nats.test:443/": "nats.test",
+		"nats.test":            "nats.test",
+	} {
+		if dc := newDialedConn(nil, addr); dc.host != host {
+			t.Errorf("Expected %s for %s, got: %s", host, addr, dc.host)
+		}
+	}
 }
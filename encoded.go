@@ -0,0 +1,271 @@
+package nats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownCodec   = errors.New("nats: unknown codec")
+	ErrPublishFailed  = errors.New("nats: publish failed")
+	ErrRequestTimeout = errors.New("nats: request timed out")
+	ErrClientStopped  = errors.New("nats: client stopped")
+)
+
+// Names of the codecs that are always registered
+const (
+	JSONCodec = "json"
+	GobCodec  = "gob"
+	RawCodec  = "raw"
+)
+
+// Converts values to and from message payloads
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	codecs     = map[string]Codec{}
+	codecsLock sync.Mutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec, jsonCodec{})
+	RegisterCodec(GobCodec, gobCodec{})
+	RegisterCodec(RawCodec, rawCodec{})
+}
+
+// Make a codec available to NewEncodedClient under name, replacing any codec
+// registered under the same name
+func RegisterCodec(name string, c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[name] = c
+}
+
+func lookupCodec(name string) (Codec, bool) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	var c, ok = codecs[name]
+
+	return c, ok
+}
+
+type jsonCodec struct {
+	// No state
+}
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct {
+	// No state
+}
+
+func (c gobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	e := gob.NewEncoder(&buf).Encode(v)
+	if e != nil {
+		return nil, e
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Passes payloads through as []byte or string
+type rawCodec struct {
+	// No state
+}
+
+func (c rawCodec) Encode(v interface{}) ([]byte, error) {
+	switch vv := v.(type) {
+	case []byte:
+		return vv, nil
+	case string:
+		return []byte(vv), nil
+	case nil:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("nats: raw codec can't encode %T", v)
+}
+
+func (c rawCodec) Decode(data []byte, v interface{}) error {
+	switch vv := v.(type) {
+	case *[]byte:
+		*vv = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*vv = string(data)
+		return nil
+	}
+
+	return fmt.Errorf("nats: raw codec can't decode into %T", v)
+}
+
+// Client that publishes and receives values, encoded with a codec
+type EncodedClient struct {
+	*Client
+
+	Codec Codec
+
+	// Called with messages that can't be decoded, which are dropped
+	ErrorHandler func(subject string, e error)
+}
+
+// Wrap c, encoding values with the codec registered under name
+func NewEncodedClient(c *Client, name string) (*EncodedClient, error) {
+	var codec, ok = lookupCodec(name)
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+
+	var ec = new(EncodedClient)
+
+	ec.Client = c
+	ec.Codec = codec
+
+	return ec, nil
+}
+
+func (ec *EncodedClient) decodeError(subject string, e error) {
+	logTo(ec.Logger, LogWarn, "dropped message that can't be decoded", "subject", subject, "error", e)
+
+	if ec.ErrorHandler != nil {
+		ec.ErrorHandler(subject, e)
+	}
+}
+
+func (ec *EncodedClient) PublishValue(subject string, v interface{}) error {
+	m, e := ec.Codec.Encode(v)
+	if e != nil {
+		return e
+	}
+
+	if !ec.Publish(subject, m) {
+		return ErrPublishFailed
+	}
+
+	return nil
+}
+
+// Publish req and decode the first reply into resp, waiting at most timeout
+func (ec *EncodedClient) RequestValue(subject string, req interface{}, resp interface{}, timeout time.Duration) error {
+	m, e := ec.Codec.Encode(req)
+	if e != nil {
+		return e
+	}
+
+	sub := ec.NewSubscription(ec.createInbox())
+	sub.SetMaximum(1)
+	sub.Subscribe()
+
+	if !ec.publish(subject, sub.subject, nil, m, TraceContext{}, false) {
+		sub.Unsubscribe()
+		return ErrPublishFailed
+	}
+
+	tc, stop := ec.clock().NewTimer(timeout)
+	defer stop()
+
+	select {
+	case rm, ok := <-sub.Inbox:
+		if !ok {
+			return ErrClientStopped
+		}
+
+		return ec.Codec.Decode(rm.Payload, resp)
+	case <-tc:
+	}
+
+	// A reply may be delivered while unsubscribing
+	go func() {
+		for range sub.Inbox {
+		}
+	}()
+
+	sub.Unsubscribe()
+
+	return ErrRequestTimeout
+}
+
+// Message decoded into a value
+type TypedMessage[T any] struct {
+	Subject string
+	ReplyTo string
+	Value   T
+}
+
+// Subscription delivering decoded values. Messages that can't be decoded are
+// passed to the client's ErrorHandler and dropped.
+type TypedSubscription[T any] struct {
+	*Subscription
+
+	// Closed when the subscription is unsubscribed or the client stops
+	C chan *TypedMessage[T]
+
+	// Closed by Unsubscribe, so decoded values nobody reads are dropped
+	done     chan bool
+	doneOnce sync.Once
+}
+
+// Unsubscribe without waiting for the values already decoded to be read
+func (ts *TypedSubscription[T]) Unsubscribe() {
+	ts.doneOnce.Do(func() { close(ts.done) })
+	ts.Subscription.Unsubscribe()
+}
+
+// Subscribe to subject, decoding every message into a T
+func Subscribe[T any](ec *EncodedClient, subject string) *TypedSubscription[T] {
+	var ts = new(TypedSubscription[T])
+
+	ts.Subscription = ec.NewSubscription(subject)
+	ts.C = make(chan *TypedMessage[T])
+	ts.done = make(chan bool)
+
+	ts.Subscribe()
+
+	go func() {
+		defer close(ts.C)
+
+		for m := range ts.Inbox {
+			var tm = new(TypedMessage[T])
+
+			tm.Subject = string(m.Subscription)
+			tm.ReplyTo = string(m.ReplyTo)
+
+			e := ec.Codec.Decode(m.Payload, &tm.Value)
+			if e != nil {
+				ec.decodeError(tm.Subject, e)
+				continue
+			}
+
+			// Keep draining the inbox until it is closed, or delivering would
+			// block while the registry is locked
+			select {
+			case ts.C <- tm:
+			case <-ts.done:
+			}
+		}
+	}()
+
+	return ts
+}
@@ -0,0 +1,292 @@
+package nats
+
+import (
+	"github.com/cloudfoundry/gonats/test"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	var v = testValue{"a", 1}
+
+	for _, name := range []string{JSONCodec, GobCodec} {
+		c, ok := lookupCodec(name)
+		if !ok {
+			t.Fatalf("Expected codec %s to be registered", name)
+		}
+
+		b, e := c.Encode(v)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		var got testValue
+		e = c.Decode(b, &got)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if got != v {
+			t.Errorf("%s: expected %#v, got %#v", name, v, got)
+		}
+	}
+}
+
+func TestRawCodec(t *testing.T) {
+	var c rawCodec
+
+	b, e := c.Encode("hi")
+	if e != nil || string(b) != "hi" {
+		t.Errorf("Expected hi, got %#v, %#v", b, e)
+	}
+
+	var s string
+	if e = c.Decode([]byte("hi"), &s); e != nil || s != "hi" {
+		t.Errorf("Expected hi, got %#v, %#v", s, e)
+	}
+
+	if _, e = c.Encode(1); e == nil {
+		t.Errorf("Expected error encoding int")
+	}
+
+	var i int
+	if e = c.Decode([]byte("1"), &i); e == nil {
+		t.Errorf("Expected error decoding into int")
+	}
+}
+
+func TestNewEncodedClientUnknownCodec(t *testing.T) {
+	_, e := NewEncodedClient(NewClient(), "unknown")
+	if e != ErrUnknownCodec {
+		t.Errorf("Expected ErrUnknownCodec, got %#v", e)
+	}
+}
+
+func setupEncoded(t *testing.T, tc *testClient) *EncodedClient {
+	ec, e := NewEncodedClient(NewClient(), JSONCodec)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	tc.SetupWith(t, ec.Client, EmptyHandshake)
+
+	return ec
+}
+
+func TestEncodedClientPublishValue(t *testing.T) {
+	var tc testClient
+
+	ec := setupEncoded(t, &tc)
+
+	tc.Add(1)
+	go func() {
+		e := ec.PublishValue("subject", testValue{"a", 1})
+		if e != nil {
+			t.Error(e)
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PUB subject 22\r\n{\"Name\":\"a\",\"Count\":1}\r\n")
+
+	tc.Teardown()
+}
+
+func TestEncodedClientPublishValueEncodeError(t *testing.T) {
+	ec, _ := NewEncodedClient(NewClient(), JSONCodec)
+
+	e := ec.PublishValue("subject", make(chan int))
+	if e == nil {
+		t.Errorf("Expected encode error")
+	}
+}
+
+func TestEncodedClientRequestValue(t *testing.T) {
+	var tc testClient
+
+	ec := setupEncoded(t, &tc)
+
+	tc.Add(1)
+	go func() {
+		var resp testValue
+
+		e := ec.RequestValue("subject", "req", &resp, time.Minute)
+		if e != nil {
+			t.Error(e)
+		}
+
+		if resp != (testValue{"b", 2}) {
+			t.Errorf("Expected response, got %#v", resp)
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertMatch("SUB _INBOX\\.[0-9a-f]{26} 1\r\n")
+	tc.s.AssertRead("UNSUB 1 1\r\n")
+	tc.s.AssertMatch("PUB subject _INBOX\\.[0-9a-f]{26} 5\r\n\"req\"\r\n")
+	tc.s.AssertWrite("MSG _INBOX 1 22\r\n{\"Name\":\"b\",\"Count\":2}\r\n")
+	tc.s.AssertRead("UNSUB 1\r\n")
+
+	tc.Teardown()
+}
+
+func TestEncodedClientRequestValueTimeout(t *testing.T) {
+	var tc testClient
+
+	ec := setupEncoded(t, &tc)
+
+	tc.Add(1)
+	go func() {
+		var resp testValue
+
+		e := ec.RequestValue("subject", "req", &resp, time.Millisecond)
+		if e != ErrRequestTimeout {
+			t.Errorf("Expected ErrRequestTimeout, got %#v", e)
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertMatch("SUB _INBOX\\.[0-9a-f]{26} 1\r\n")
+	tc.s.AssertRead("UNSUB 1 1\r\n")
+	tc.s.AssertMatch("PUB subject _INBOX\\.[0-9a-f]{26} 5\r\n\"req\"\r\n")
+	tc.s.AssertRead("UNSUB 1\r\n")
+
+	tc.Teardown()
+}
+
+func TestEncodedClientRequestValueTimeoutOnClock(t *testing.T) {
+	var tc testClient
+
+	fc := test.NewFakeClock()
+
+	ec, _ := NewEncodedClient(NewClient(), JSONCodec)
+	ec.Clock = fc
+
+	// The only thing waiting on the clock is the request
+	ec.PingInterval = 0
+
+	tc.SetupWith(t, ec.Client, EmptyHandshake)
+
+	var ec2 = make(chan error, 1)
+
+	tc.Add(1)
+	go func() {
+		var resp testValue
+
+		ec2 <- ec.RequestValue("subject", "req", &resp, time.Hour)
+		tc.Done()
+	}()
+
+	tc.s.AssertMatch("SUB _INBOX\\.[0-9a-f]{26} 1\r\n")
+	tc.s.AssertRead("UNSUB 1 1\r\n")
+	tc.s.AssertMatch("PUB subject _INBOX\\.[0-9a-f]{26} 5\r\n\"req\"\r\n")
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour - time.Nanosecond)
+
+	select {
+	case e := <-ec2:
+		t.Errorf("Expected request to wait, got %#v", e)
+	default:
+	}
+
+	fc.Advance(time.Nanosecond)
+
+	tc.s.AssertRead("UNSUB 1\r\n")
+
+	if e := <-ec2; e != ErrRequestTimeout {
+		t.Errorf("Expected ErrRequestTimeout, got %#v", e)
+	}
+
+	tc.Teardown()
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	var tc testClient
+	var errc = make(chan string, 1)
+	var mc = make(chan []*TypedMessage[testValue], 1)
+
+	ec := setupEncoded(t, &tc)
+	ec.ErrorHandler = func(subject string, e error) {
+		errc <- subject
+	}
+
+	tc.Add(1)
+	go func() {
+		sub := Subscribe[testValue](ec, "subject")
+
+		var ms []*TypedMessage[testValue]
+		for m := range sub.C {
+			ms = append(ms, m)
+		}
+
+		mc <- ms
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+	tc.s.AssertWrite("MSG subject 1 3\r\nbad\r\n")
+	tc.s.AssertWrite("MSG subject 1 reply 22\r\n{\"Name\":\"a\",\"Count\":1}\r\n")
+
+	if s := <-errc; s != "subject" {
+		t.Errorf("Expected decode error for subject, got %#v", s)
+	}
+
+	// Don't stop before the message was delivered
+	tc.Add(1)
+	go func() {
+		tc.c.Ping()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	tc.Teardown()
+
+	var expected = []*TypedMessage[testValue]{{"subject", "reply", testValue{"a", 1}}}
+	if got := <-mc; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, got)
+	}
+}
+
+func TestSubscribeTypedUnsubscribeWithoutReading(t *testing.T) {
+	var tc testClient
+
+	ec := setupEncoded(t, &tc)
+
+	tc.Add(1)
+	go func() {
+		sub := Subscribe[testValue](ec, "subject")
+
+		// Round trip so both messages were read, and none taken from C
+		tc.c.Ping()
+
+		sub.Unsubscribe()
+
+		if _, ok := <-sub.C; ok {
+			t.Error("Expected C to be closed")
+		}
+
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+	tc.s.AssertWrite("MSG subject 1 22\r\n{\"Name\":\"a\",\"Count\":1}\r\n")
+	tc.s.AssertWrite("MSG subject 1 22\r\n{\"Name\":\"b\",\"Count\":2}\r\n")
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+	tc.s.AssertRead("UNSUB 1\r\n")
+
+	tc.Teardown()
+}
@@ -0,0 +1,318 @@
+package nats
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cloudfoundry/gonats/internal/match"
+)
+
+// Message published to a FakeClient
+type FakeMessage struct {
+	Subject string
+	ReplyTo string
+	Header  Header
+	Payload []byte
+}
+
+// In-memory client for testing code that depends on Conn without a server.
+// Messages are routed to its own subscriptions like a server would, with
+// wildcards, queue groups and maximums, and every publish is recorded.
+// Delivery is asynchronous and in publish order; inboxes are unbuffered, like
+// the ones of Client.
+type FakeClient struct {
+	// Guards the subscriptions, and is held while delivering
+	sLock sync.Mutex
+	sid   uint
+	subs  map[uint]*Subscription
+
+	// Rotates deliveries within queue groups
+	rotation int
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	published    []*FakeMessage
+	queue        []*FakeMessage
+	dispatching  bool
+	disconnected bool
+	inboxes      int
+}
+
+func NewFakeClient() *FakeClient {
+	var f = new(FakeClient)
+
+	f.subs = make(map[uint]*Subscription)
+	f.cond = sync.NewCond(&f.lock)
+
+	return f
+}
+
+func (f *FakeClient) NewSubscription(sub string) *Subscription {
+	var s = new(Subscription)
+
+	f.sLock.Lock()
+	f.sid++
+	s.sid = f.sid
+	f.sLock.Unlock()
+
+	s.sr = f
+	s.SetSubject(sub)
+	s.Inbox = make(chan *readMessage)
+
+	return s
+}
+
+// Called through Subscription.Subscribe
+func (f *FakeClient) Subscribe(s *Subscription) {
+	f.sLock.Lock()
+	defer f.sLock.Unlock()
+
+	f.subs[s.sid] = s
+	s.freeze()
+}
+
+// Called through Subscription.Unsubscribe
+func (f *FakeClient) Unsubscribe(s *Subscription) {
+	f.sLock.Lock()
+	defer f.sLock.Unlock()
+
+	if _, ok := f.subs[s.sid]; !ok {
+		return
+	}
+
+	delete(f.subs, s.sid)
+	close(s.Inbox)
+}
+
+func (f *FakeClient) publish(s string, r string, h Header, m []byte) bool {
+	var fm = &FakeMessage{Subject: s, ReplyTo: r, Payload: append([]byte{}, m...)}
+
+	// Like Client, which couldn't encode it
+	if h.validate() != nil {
+		return false
+	}
+
+	if len(h) > 0 {
+		fm.Header = make(Header, len(h))
+		for k, v := range h {
+			fm.Header[k] = append([]string(nil), v...)
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.disconnected {
+		return false
+	}
+
+	f.published = append(f.published, fm)
+	f.queue = append(f.queue, fm)
+
+	if !f.dispatching {
+		f.dispatching = true
+		go f.dispatch()
+	}
+
+	return true
+}
+
+func (f *FakeClient) Publish(s string, m []byte) bool {
+	return f.publish(s, "", nil, m)
+}
+
+func (f *FakeClient) PublishAndConfirm(s string, m []byte) bool {
+	return f.publish(s, "", nil, m)
+}
+
+func (f *FakeClient) PublishWithHeader(s string, h Header, m []byte) bool {
+	return f.publish(s, "", h, m)
+}
+
+func (f *FakeClient) PublishWithReply(s string, r string, m []byte) bool {
+	return f.publish(s, r, nil, m)
+}
+
+// Like Client.Request, with inboxes numbered in order so they are
+// predictable in tests
+func (f *FakeClient) Request(s string, m []byte, cb func(*Subscription)) bool {
+	f.lock.Lock()
+	f.inboxes++
+	var r = fmt.Sprintf("_INBOX.fake.%d", f.inboxes)
+	f.lock.Unlock()
+
+	sub := f.NewSubscription(r)
+	sub.Subscribe()
+
+	go cb(sub)
+
+	return f.publish(s, r, nil, m)
+}
+
+// Deliver queued messages until there are none left
+func (f *FakeClient) dispatch() {
+	for {
+		f.lock.Lock()
+
+		if len(f.queue) == 0 {
+			f.dispatching = false
+			f.cond.Broadcast()
+			f.lock.Unlock()
+			return
+		}
+
+		var fm = f.queue[0]
+		f.queue = f.queue[1:]
+
+		f.lock.Unlock()
+
+		f.deliver(fm)
+	}
+}
+
+// Queue groups are per subject, like on a server. Neither the queue nor the
+// subject contain spaces.
+func queueGroup(s *Subscription) string {
+	return s.queue + " " + s.subject
+}
+
+// Deliver to every matching subscription outside queue groups, and to one
+// subscription per queue group
+func (f *FakeClient) deliver(fm *FakeMessage) {
+	f.sLock.Lock()
+	defer f.sLock.Unlock()
+
+	var sids = make([]uint, 0, len(f.subs))
+	for sid := range f.subs {
+		sids = append(sids, sid)
+	}
+
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+
+	var targets []*Subscription
+	var groups = make(map[string][]*Subscription)
+	var names []string
+
+	for _, sid := range sids {
+		var s = f.subs[sid]
+		if !match.Subject(s.subject, fm.Subject) {
+			continue
+		}
+
+		if s.queue == "" {
+			targets = append(targets, s)
+			continue
+		}
+
+		var name = queueGroup(s)
+		if groups[name] == nil {
+			names = append(names, name)
+		}
+
+		groups[name] = append(groups[name], s)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		var g = groups[name]
+
+		f.rotation++
+		targets = append(targets, g[f.rotation%len(g)])
+	}
+
+	for _, s := range targets {
+		s.deliver(&readMessage{
+			Subscription:   []byte(fm.Subject),
+			SubscriptionId: s.sid,
+			ReplyTo:        []byte(fm.ReplyTo),
+			Header:         fm.Header,
+			Payload:        fm.Payload,
+		})
+
+		// Unsubscribe if the maximum number of messages has been received
+		if s.isDone() {
+			delete(f.subs, s.sid)
+			close(s.Inbox)
+		}
+	}
+}
+
+// Wait until every message published so far has been delivered
+func (f *FakeClient) Flush() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for f.dispatching {
+		f.cond.Wait()
+	}
+}
+
+// Have publishes fail, as if the client lost its connection, or succeed again
+func (f *FakeClient) SetDisconnected(v bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.disconnected = v
+}
+
+// Messages published on subjects matching pattern, which may contain
+// wildcards, in the order they were published
+func (f *FakeClient) Published(pattern string) []*FakeMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var r []*FakeMessage
+	for _, fm := range f.published {
+		if match.Subject(pattern, fm.Subject) {
+			r = append(r, fm)
+		}
+	}
+
+	return r
+}
+
+// Forget the messages published so far
+func (f *FakeClient) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.published = nil
+}
+
+// Subscriptions matching subject, counting each queue group once
+func (f *FakeClient) Interest(subject string) int {
+	f.sLock.Lock()
+	defer f.sLock.Unlock()
+
+	var n int
+	var groups = make(map[string]bool)
+
+	for _, s := range f.subs {
+		if !match.Subject(s.subject, subject) {
+			continue
+		}
+
+		if s.queue == "" {
+			n++
+		} else if !groups[queueGroup(s)] {
+			groups[queueGroup(s)] = true
+			n++
+		}
+	}
+
+	return n
+}
+
+// Remove all subscriptions, closing their inboxes
+func (f *FakeClient) Close() {
+	f.sLock.Lock()
+	defer f.sLock.Unlock()
+
+	for _, s := range f.subs {
+		close(s.Inbox)
+	}
+
+	f.subs = make(map[uint]*Subscription)
+}
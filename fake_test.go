@@ -0,0 +1,209 @@
+package nats
+
+import (
+	"testing"
+	"time"
+)
+
+var _ Conn = NewClient()
+var _ Conn = NewFakeClient()
+
+func TestFakeClientRoutesWildcards(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var star = f.NewSubscription("foo.*")
+	star.Subscribe()
+
+	var gt = f.NewSubscription("foo.>")
+	gt.Subscribe()
+
+	f.Publish("foo.bar", []byte("1"))
+	f.Publish("foo.bar.baz", []byte("2"))
+
+	if m := receive(t, star); m == nil || string(m.Payload) != "1" || string(m.Subscription) != "foo.bar" {
+		t.Errorf("Expected foo.bar on foo.*, got %#v", m)
+	}
+
+	for _, p := range []string{"1", "2"} {
+		if m := receive(t, gt); m == nil || string(m.Payload) != p {
+			t.Errorf("Expected %s on foo.>, got %#v", p, m)
+		}
+	}
+
+	f.Flush()
+
+	select {
+	case m := <-star.Inbox:
+		t.Errorf("Expected nothing more on foo.*, got %#v", m)
+	default:
+	}
+}
+
+func TestFakeClientQueueGroup(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var counts = make(chan int, 20)
+
+	for i := 0; i < 2; i++ {
+		sub := f.NewSubscription("work")
+		sub.SetQueue("workers")
+		sub.Subscribe()
+
+		go func(i int) {
+			for range sub.Inbox {
+				counts <- i
+			}
+		}(i)
+	}
+
+	if n := f.Interest("work"); n != 1 {
+		t.Errorf("Expected the group to count once, got %d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		f.Publish("work", nil)
+	}
+
+	f.Flush()
+
+	var seen [2]int
+	for i := 0; i < 10; i++ {
+		seen[<-counts]++
+	}
+
+	if seen[0] != 5 || seen[1] != 5 {
+		t.Errorf("Expected 5 messages per member, got %v", seen)
+	}
+}
+
+// A queue name shared by subscriptions to different subjects makes
+// different groups
+func TestFakeClientQueueGroupPerSubject(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var subs []*Subscription
+	for _, subject := range []string{"work.*", "work.a"} {
+		sub := f.NewSubscription(subject)
+		sub.SetQueue("workers")
+		sub.Subscribe()
+
+		subs = append(subs, sub)
+	}
+
+	if n := f.Interest("work.a"); n != 2 {
+		t.Errorf("Expected two groups, got %d", n)
+	}
+
+	f.Publish("work.a", []byte("hi"))
+
+	for _, sub := range subs {
+		if m := <-sub.Inbox; string(m.Payload) != "hi" {
+			t.Errorf("Expected hi on %s, got %#v", sub.Subject(), m)
+		}
+	}
+}
+
+func TestFakeClientMaximum(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var sub = f.NewSubscription("foo")
+	sub.SetMaximum(2)
+	sub.Subscribe()
+
+	for i := 0; i < 3; i++ {
+		f.Publish("foo", nil)
+	}
+
+	receive(t, sub)
+	receive(t, sub)
+
+	if _, ok := <-sub.Inbox; ok {
+		t.Errorf("Expected inbox to be closed after the maximum")
+	}
+
+	if n := f.Interest("foo"); n != 0 {
+		t.Errorf("Expected no interest, got %d", n)
+	}
+}
+
+func TestFakeClientRequest(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var sub = f.NewSubscription("svc")
+	sub.Subscribe()
+
+	go func() {
+		for m := range sub.Inbox {
+			f.Publish(string(m.ReplyTo), append([]byte("re: "), m.Payload...))
+		}
+	}()
+
+	var rc = make(chan string, 1)
+
+	f.Request("svc", []byte("hi"), func(s *Subscription) {
+		m := <-s.Inbox
+		s.Unsubscribe()
+		rc <- string(m.Payload)
+	})
+
+	select {
+	case r := <-rc:
+		if r != "re: hi" {
+			t.Errorf("Expected re: hi, got %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reply")
+	}
+
+	if p := f.Published("_INBOX.>"); len(p) != 1 || p[0].Subject != "_INBOX.fake.1" {
+		t.Errorf("Expected reply on _INBOX.fake.1, got %#v", p)
+	}
+}
+
+func TestFakeClientRecordsPublishes(t *testing.T) {
+	var f = NewFakeClient()
+	defer f.Close()
+
+	var h = Header{}
+	h.Set("k", "v")
+
+	var m = []byte("hi")
+
+	f.PublishWithReply("foo.1", "bar", m)
+	f.PublishWithHeader("foo.2", h, nil)
+	f.Publish("other", nil)
+
+	// Later changes don't affect what was recorded
+	m[0] = 'x'
+	h.Set("k", "w")
+
+	p := f.Published("foo.*")
+	if len(p) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(p))
+	}
+
+	if p[0].ReplyTo != "bar" || string(p[0].Payload) != "hi" {
+		t.Errorf("Expected hi with reply bar, got %#v", p[0])
+	}
+
+	if p[1].Header.Get("k") != "v" {
+		t.Errorf("Expected header k: v, got %#v", p[1].Header)
+	}
+
+	f.SetDisconnected(true)
+
+	if f.Publish("foo.3", nil) {
+		t.Errorf("Expected publish to fail while disconnected")
+	}
+
+	f.Reset()
+
+	if p := f.Published(">"); len(p) != 0 {
+		t.Errorf("Expected no messages after Reset, got %d", len(p))
+	}
+}
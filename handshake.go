@@ -2,18 +2,50 @@ package nats
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"time"
 )
 
 var (
 	ErrAuthenticationFailure = errors.New("nats: authentication failed")
 	ErrHandshakeTimeout      = errors.New("nats: handshake timed out")
+	ErrCertificateMismatch   = errors.New("nats: server certificate is not pinned")
+	ErrServerNameRequired    = errors.New("nats: no server name to verify the certificate against")
 )
 
+// Time every step of the handshake may take if a Handshake has no Timeout
+const DefaultHandshakeTimeout = 5 * time.Second
+
+// Returned when the server sends something the handshake didn't expect at
+// that point, such as a load balancer speaking another protocol
+type ProtocolError struct {
+	Expected string
+	Received string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("nats: protocol error: expected %s, received %s", e.Expected, e.Received)
+}
+
+// Performs the handshake on a freshly dialed connection, returning the
+// connection to use for the session and what the server said about itself.
+// The info may be nil if the handshaker doesn't read it; its Headers is only
+// set if the session negotiated headers, not just if the server supports them.
 type Handshaker interface {
-	Handshake(net.Conn) (net.Conn, error)
+	Handshake(net.Conn) (net.Conn, *ServerInfo, error)
+}
+
+// Implemented by connections that know the host they were dialed with, which
+// TLS verifies the server certificate against if TLSConfig has no
+// ServerName. Connections from RetryingDialer and WebSocketDialer implement
+// it, and connections wrapping another should forward it.
+type DialedHoster interface {
+	DialedHost() string
 }
 
 var EmptyHandshake = emptyHandshake{}
@@ -22,24 +54,207 @@ type emptyHandshake struct {
 	// Not much...
 }
 
-func (h emptyHandshake) Handshake(n net.Conn) (net.Conn, error) {
-	return n, nil
+func (h emptyHandshake) Handshake(n net.Conn) (net.Conn, *ServerInfo, error) {
+	return n, nil, nil
+}
+
+// Implemented by handshakers that may put the session in verbose mode, where
+// the server acknowledges every command with +OK or -ERR
+type VerboseHandshaker interface {
+	Handshaker
+	VerboseMode() bool
 }
 
 type Handshake struct {
-	Username string
-	Password string
+	Username  string
+	Password  string
+	AuthToken string
+
+	// Have the server acknowledge every command
+	Verbose bool
+
+	// Have the server perform strict checking of commands
+	Pedantic bool
+
+	// Identification of the client, shown in the server's monitoring
+	Name    string
+	Lang    string
+	Version string
+
+	// Protocol version supported by the client. Servers only send INFO
+	// during the session, such as cluster topology updates, to clients that
+	// support protocol 1.
+	Protocol int
+
+	// Don't receive messages published by this connection
+	NoEcho bool
+
+	// Request support for message headers, if the server advertises it
+	Headers bool
+
+	// Configuration used when upgrading to TLS. Root CAs, client certificates,
+	// the server name and the minimum version are all taken from here. When
+	// nil, the server certificate is not verified. Without a server name the
+	// certificate is verified against the host the connection was dialed
+	// with, see DialedHoster, or fails with ErrServerNameRequired.
+	TLSConfig *tls.Config
+
+	// Upgrade to TLS even if the server doesn't require it
+	TLSRequired bool
+
+	// SHA-256 fingerprints of the DER encoded certificates the server is
+	// allowed to present. When empty, any certificate that passes
+	// verification is accepted.
+	TLSPinnedCertificates [][]byte
+
+	// Where completed handshakes are reported, if set. Failures are returned
+	// for the caller to report.
+	Logger Logger
+
+	// Maximum time each step of the handshake may take: receiving INFO, the
+	// TLS upgrade, sending CONNECT and receiving the acknowledgement. Uses
+	// DefaultHandshakeTimeout when zero.
+	Timeout time.Duration
+}
+
+func (h Handshake) VerboseMode() bool {
+	return h.Verbose
+}
+
+func (h Handshake) connect() *writeConnect {
+	var o = &writeConnect{
+		Verbose:   h.Verbose,
+		Pedantic:  h.Pedantic,
+		User:      h.Username,
+		Pass:      h.Password,
+		AuthToken: h.AuthToken,
+		Name:      h.Name,
+		Lang:      h.Lang,
+		Version:   h.Version,
+		Protocol:  h.Protocol,
+		Headers:   h.Headers,
+	}
+
+	if h.NoEcho {
+		var echo = false
+		o.Echo = &echo
+	}
+
+	return o
+}
+
+func (h Handshake) tlsConfig(c net.Conn) (*tls.Config, error) {
+	if h.TLSConfig == nil {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	var config = h.TLSConfig.Clone()
+
+	// Verify against the host that was dialed if no server name was given,
+	// never against the address it resolved to
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		dh, ok := c.(DialedHoster)
+		if !ok || dh.DialedHost() == "" {
+			return nil, ErrServerNameRequired
+		}
+
+		config.ServerName = dh.DialedHost()
+	}
+
+	return config, nil
+}
+
+func (h Handshake) upgrade(c net.Conn) (net.Conn, error) {
+	config, e := h.tlsConfig(c)
+	if e != nil {
+		return nil, e
+	}
+
+	var tc = tls.Client(c, config)
+
+	// Complete the TLS handshake before credentials are sent
+	e = tc.Handshake()
+	if e != nil {
+		return nil, e
+	}
+
+	if len(h.TLSPinnedCertificates) > 0 {
+		e = h.verifyPin(tc.ConnectionState())
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	return tc, nil
+}
+
+func (h Handshake) verifyPin(s tls.ConnectionState) error {
+	if len(s.PeerCertificates) == 0 {
+		return ErrCertificateMismatch
+	}
+
+	var sum = sha256.Sum256(s.PeerCertificates[0].Raw)
+
+	for _, p := range h.TLSPinnedCertificates {
+		if bytes.Equal(p, sum[:]) {
+			return nil
+		}
+	}
+
+	return ErrCertificateMismatch
 }
 
-func (h Handshake) Handshake(c net.Conn) (net.Conn, error) {
+func (h Handshake) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+
+	return DefaultHandshakeTimeout
+}
+
+// Give the next step of the handshake a fresh deadline. Deadlines are
+// enforced by the network stack, so they use real time rather than a Clock.
+func (h Handshake) deadline(c net.Conn) error {
+	return c.SetDeadline(time.Now().Add(h.timeout()))
+}
+
+func (h Handshake) Handshake(c net.Conn) (net.Conn, *ServerInfo, error) {
+	var n net.Conn
+	var info *ServerInfo
+	var e error
+
+	n, info, e = h.handshake(c)
+	if e != nil {
+		// Don't leave a half-initialized connection behind
+		c.Close()
+
+		var ne net.Error
+		if errors.As(e, &ne) && ne.Timeout() {
+			e = ErrHandshakeTimeout
+		}
+
+		return nil, nil, e
+	}
+
+	logTo(h.Logger, LogDebug, "handshake completed", "server_id", info.ServerId, "version", info.Version)
+
+	return n, info, nil
+}
+
+func (h Handshake) handshake(c net.Conn) (net.Conn, *ServerInfo, error) {
 	var r = bufio.NewReader(c)
 	var w = bufio.NewWriter(c)
 	var ro readObject
 	var e error
 
+	e = h.deadline(c)
+	if e != nil {
+		return nil, nil, e
+	}
+
 	ro, e = read(r)
 	if e != nil {
-		return nil, e
+		return nil, nil, e
 	}
 
 	var info *readInfo
@@ -47,45 +262,93 @@ func (h Handshake) Handshake(c net.Conn) (net.Conn, error) {
 
 	info, ok = ro.(*readInfo)
 	if !ok {
-		panic("expected INFO")
+		return nil, nil, &ProtocolError{Expected: "INFO", Received: objectName(ro)}
 	}
 
-	if info.SslRequired {
-		c = tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if info.SslRequired || h.TLSRequired {
+		e = h.deadline(c)
+		if e != nil {
+			return nil, nil, e
+		}
+
+		c, e = h.upgrade(c)
+		if e != nil {
+			return nil, nil, e
+		}
+
 		r = bufio.NewReader(c)
 		w = bufio.NewWriter(c)
 	}
 
-	var wo writeObject = &writeConnect{
-		Verbose:  true,
-		Pedantic: true,
-		User:     h.Username,
-		Pass:     h.Password,
+	var wo = h.connect()
+
+	// Only ask for headers if the server supports them
+	wo.Headers = h.Headers && info.Headers
+
+	e = h.deadline(c)
+	if e != nil {
+		return nil, nil, e
 	}
 
-	e = writeAndFlush(w, wo)
+	e = write(w, wo)
 	if e != nil {
-		return nil, e
+		return nil, nil, e
+	}
+
+	// Only a verbose server acknowledges CONNECT; otherwise the PONG tells
+	// the CONNECT was accepted
+	if !wo.Verbose {
+		e = write(w, &writePing{})
+		if e != nil {
+			return nil, nil, e
+		}
+	}
+
+	e = w.Flush()
+	if e != nil {
+		return nil, nil, e
+	}
+
+	e = h.deadline(c)
+	if e != nil {
+		return nil, nil, e
 	}
 
 	ro, e = read(r)
 	if e != nil {
-		return nil, e
+		return nil, nil, e
+	}
+
+	var expected = "+OK or -ERR"
+	if !wo.Verbose {
+		expected = "PONG or -ERR"
 	}
 
 	switch ro.(type) {
 	case *readOk:
+		ok = wo.Verbose
+	case *readPong:
+		ok = !wo.Verbose
 	case *readErr:
-		e = ErrAuthenticationFailure
+		return nil, nil, ErrAuthenticationFailure
 	default:
-		panic("expected OK or ERR")
+		ok = false
+	}
+
+	if !ok {
+		return nil, nil, &ProtocolError{Expected: expected, Received: objectName(ro)}
 	}
 
+	// The session itself has no deadline
+	e = c.SetDeadline(time.Time{})
 	if e != nil {
-		return nil, e
+		return nil, nil, e
 	}
 
-	return c, nil
+	// The client can only send headers if it asked for them
+	info.Headers = wo.Headers
+
+	return c, (*ServerInfo)(info), nil
 }
 
 func DefaultHandshaker(username, password string) Handshaker {
@@ -93,6 +356,14 @@ func DefaultHandshaker(username, password string) Handshaker {
 
 	h.Username = username
 	h.Password = password
+	h.Verbose = true
+	h.Pedantic = true
+
+	// Receive cluster topology updates
+	h.Protocol = 1
+
+	// Use message headers where available
+	h.Headers = true
 
 	return h
 }
@@ -1,14 +1,25 @@
 package nats
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/cloudfoundry/gonats/test"
 	"net"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 )
 
 func testHandshake(t *testing.T, user, pass string, ssl bool) {
+	h := DefaultHandshaker(user, pass).(Handshake)
+
+	testHandshakeWith(t, h, ssl, ssl)
+}
+
+func testHandshakeWith(t *testing.T, h Handshake, ssl bool, upgrade bool) {
 	c, s := net.Pipe()
 	srv := test.NewTestServer(t, s)
 	wg := sync.WaitGroup{}
@@ -16,12 +27,7 @@ func testHandshake(t *testing.T, user, pass string, ssl bool) {
 	wg.Add(1)
 
 	go func() {
-		h := Handshake{
-			Username: user,
-			Password: pass,
-		}
-
-		_, e := h.Handshake(c)
+		_, _, e := h.Handshake(c)
 		if e != nil {
 			t.Error(e)
 		}
@@ -40,19 +46,118 @@ func testHandshake(t *testing.T, user, pass string, ssl bool) {
 	p = fmt.Sprintf("INFO {\"ssl_required\":%s}\r\n", p)
 	srv.AssertWrite(p)
 
-	if ssl {
+	if upgrade {
 		srv.StartTLS()
 	}
 
-	p = fmt.Sprintf("CONNECT {\"verbose\":true,\"pedantic\":true,\"user\":\"%s\",\"pass\":\"%s\"}\r\n", user, pass)
-	srv.AssertRead(p)
+	p = fmt.Sprintf("CONNECT {\"verbose\":%t,\"pedantic\":%t,\"user\":\"%s\",\"pass\":\"%s\"", h.Verbose, h.Pedantic, h.Username, h.Password)
+	if h.Protocol != 0 {
+		p += fmt.Sprintf(",\"protocol\":%d", h.Protocol)
+	}
+	p += "}\r\n"
 
-	p = fmt.Sprintf("+OK\r\n")
-	srv.AssertWrite(p)
+	// Accepted with +OK in verbose mode, with the PONG otherwise
+	if h.Verbose {
+		srv.AssertRead(p)
+		srv.AssertWrite("+OK\r\n")
+	} else {
+		srv.AssertRead(p + "PING\r\n")
+		srv.AssertWrite("PONG\r\n")
+	}
 
 	wg.Wait()
 }
 
+func testHandshakeTLSError(t *testing.T, h Handshake, expected error) {
+	testHandshakeTLSErrorWith(t, h, nil, expected)
+}
+
+// Expect the TLS upgrade to fail, with the server using config if set
+func testHandshakeTLSErrorWith(t *testing.T, h Handshake, config *tls.Config, expected error) error {
+	// Over a pipe the client's alert blocks until the handshake deadline
+	if h.Timeout == 0 {
+		h.Timeout = 100 * time.Millisecond
+	}
+
+	c, s := net.Pipe()
+	srv := test.NewTestServer(t, s)
+	ec := make(chan error, 1)
+
+	go func() {
+		_, _, e := h.Handshake(c)
+		ec <- e
+	}()
+
+	srv.AssertWrite("INFO {\"ssl_required\":true}\r\n")
+
+	if config != nil {
+		srv.StartTLSWith(config)
+	} else {
+		srv.StartTLS()
+	}
+
+	// Drive the server side of the TLS handshake; the client hangs up
+	srv.Conn.Read(make([]byte, 1))
+	srv.Conn.Close()
+
+	e := <-ec
+	if e == nil {
+		t.Errorf("Expected error")
+		return nil
+	}
+
+	if expected != nil && e != expected {
+		t.Errorf("Expected: %#v, got: %#v", expected, e)
+	}
+
+	return e
+}
+
+// Expect CONNECT, followed by PING unless verbose, and accept it
+func acceptConnect(srv *test.TestServer, verbose bool) {
+	if verbose {
+		srv.AssertMatch("^CONNECT .*\r\n$")
+		srv.AssertWrite("+OK\r\n")
+	} else {
+		srv.AssertMatch("^CONNECT .*\r\nPING\r\n$")
+		srv.AssertWrite("PONG\r\n")
+	}
+}
+
+// Upgrade to TLS with the server using config, and complete the handshake
+func testHandshakeTLS(t *testing.T, h Handshake, config *tls.Config) tls.ConnectionState {
+	var state tls.ConnectionState
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {\"ssl_required\":true}\r\n")
+		srv.StartTLSWith(config)
+		acceptConnect(srv, h.Verbose)
+
+		state = srv.Conn.(*tls.Conn).ConnectionState()
+	})
+
+	if e != nil {
+		t.Error(e)
+	}
+
+	return state
+}
+
+// CA and a server certificate for nats.test
+func testPKI(t *testing.T) (*test.CA, tls.Certificate) {
+	ca, e := test.NewCA()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cert, e := ca.Issue(test.CertOptions{DNSNames: []string{"nats.test"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return ca, cert
+}
+
 func TestHandshakeWithoutAuth(t *testing.T) {
 	testHandshake(t, "", "", false)
 }
@@ -68,3 +173,372 @@ func TestHandshakeWithoutAuthWithSsl(t *testing.T) {
 func TestHandshakeWithAuthWithSsl(t *testing.T) {
 	testHandshake(t, "john", "doe", true)
 }
+
+func TestHandshakeWithTLSRequired(t *testing.T) {
+	h := Handshake{
+		TLSRequired: true,
+	}
+
+	testHandshakeWith(t, h, false, true)
+}
+
+func TestHandshakeWithPinnedCertificate(t *testing.T) {
+	h := Handshake{
+		TLSPinnedCertificates: [][]byte{test.CertificateFingerprint()},
+	}
+
+	testHandshakeWith(t, h, true, true)
+}
+
+func TestHandshakeWithWrongPinnedCertificate(t *testing.T) {
+	h := Handshake{
+		TLSPinnedCertificates: [][]byte{make([]byte, 32)},
+	}
+
+	testHandshakeTLSError(t, h, ErrCertificateMismatch)
+}
+
+func TestHandshakeWithTLSConfigVerifiesCertificate(t *testing.T) {
+	h := Handshake{
+		TLSConfig: &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    x509.NewCertPool(),
+		},
+	}
+
+	testHandshakeTLSError(t, h, nil)
+}
+
+func TestHandshakeWithVerifiedCertificate(t *testing.T) {
+	ca, cert := testPKI(t)
+
+	h := Handshake{
+		TLSConfig:             ca.ClientConfig("nats.test"),
+		TLSPinnedCertificates: [][]byte{test.Fingerprint(cert)},
+	}
+
+	testHandshakeTLS(t, h, ca.ServerConfig(cert, false))
+}
+
+// A certificate with only DNS names is verified against the dialed host
+func TestHandshakeWithDialedHost(t *testing.T) {
+	testHandshakeWithDialedHost(t, func(n net.Conn) net.Conn { return n })
+}
+
+// Wrappers forward the dialed host
+func TestHandshakeWithDialedHostThroughWrapper(t *testing.T) {
+	testHandshakeWithDialedHost(t, func(n net.Conn) net.Conn { return test.NewFaultConn(n) })
+}
+
+func testHandshakeWithDialedHost(t *testing.T, wrap func(net.Conn) net.Conn) {
+	ca, cert := testPKI(t)
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig(""),
+	}
+
+	c, s := net.Pipe()
+	srv := test.NewTestServer(t, s)
+	ec := make(chan error, 1)
+
+	go func() {
+		_, _, e := h.Handshake(wrap(newDialedConn(c, "nats.test:4222")))
+		ec <- e
+	}()
+
+	srv.AssertWrite("INFO {\"ssl_required\":true}\r\n")
+	srv.StartTLSWith(ca.ServerConfig(cert, false))
+	acceptConnect(srv, false)
+
+	if e := <-ec; e != nil {
+		t.Error(e)
+	}
+}
+
+func TestHandshakeWithoutServerName(t *testing.T) {
+	ca, cert := testPKI(t)
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig(""),
+	}
+
+	testHandshakeTLSErrorWith(t, h, ca.ServerConfig(cert, false), ErrServerNameRequired)
+}
+
+func TestHandshakeWithCertificateForOtherName(t *testing.T) {
+	ca, cert := testPKI(t)
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig("other.test"),
+	}
+
+	e := testHandshakeTLSErrorWith(t, h, ca.ServerConfig(cert, false), nil)
+	var he x509.HostnameError
+	if !errors.As(e, &he) {
+		t.Errorf("Expected hostname error, got: %#v", e)
+	}
+}
+
+func TestHandshakeWithCertificateFromOtherCA(t *testing.T) {
+	ca, cert := testPKI(t)
+	other, _ := testPKI(t)
+
+	h := Handshake{
+		TLSConfig: other.ClientConfig("nats.test"),
+	}
+
+	e := testHandshakeTLSErrorWith(t, h, ca.ServerConfig(cert, false), nil)
+	var ue x509.UnknownAuthorityError
+	if !errors.As(e, &ue) {
+		t.Errorf("Expected unknown authority error, got: %#v", e)
+	}
+}
+
+func TestHandshakeWithExpiredCertificate(t *testing.T) {
+	ca, _ := testPKI(t)
+
+	cert, e := ca.Issue(test.CertOptions{
+		DNSNames:  []string{"nats.test"},
+		NotBefore: time.Now().Add(-2 * time.Hour),
+		NotAfter:  time.Now().Add(-time.Hour),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig("nats.test"),
+	}
+
+	e = testHandshakeTLSErrorWith(t, h, ca.ServerConfig(cert, false), nil)
+	var ce x509.CertificateInvalidError
+	if !errors.As(e, &ce) || ce.Reason != x509.Expired {
+		t.Errorf("Expected expired certificate error, got: %#v", e)
+	}
+}
+
+func TestHandshakeWithClientCertificate(t *testing.T) {
+	ca, cert := testPKI(t)
+
+	client, e := ca.Issue(test.CertOptions{CommonName: "client", Client: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig("nats.test", client),
+	}
+
+	state := testHandshakeTLS(t, h, ca.ServerConfig(cert, true))
+
+	if len(state.PeerCertificates) != 1 || state.PeerCertificates[0].Subject.CommonName != "client" {
+		t.Errorf("Expected client certificate, got: %#v", state.PeerCertificates)
+	}
+}
+
+func TestHandshakeWithoutRequiredClientCertificate(t *testing.T) {
+	ca, cert := testPKI(t)
+
+	h := Handshake{
+		TLSConfig: ca.ClientConfig("nats.test"),
+	}
+
+	testHandshakeTLSErrorWith(t, h, ca.ServerConfig(cert, true), nil)
+}
+
+func testHandshakeScript(t *testing.T, h Handshake, f func(*test.TestServer)) error {
+	c, s := net.Pipe()
+	srv := test.NewTestServer(t, s)
+	ec := make(chan error, 1)
+
+	go func() {
+		_, _, e := h.Handshake(c)
+		ec <- e
+	}()
+
+	f(srv)
+
+	return <-ec
+}
+
+func TestHandshakeTimeoutWaitingForInfo(t *testing.T) {
+	h := Handshake{
+		Timeout: 10 * time.Millisecond,
+	}
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+	})
+
+	if e != ErrHandshakeTimeout {
+		t.Errorf("Expected: %#v, got: %#v", ErrHandshakeTimeout, e)
+	}
+}
+
+func TestHandshakeTimeoutWaitingForPong(t *testing.T) {
+	h := Handshake{
+		Timeout: 10 * time.Millisecond,
+	}
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {}\r\n")
+		srv.AssertMatch("^CONNECT .*\r\nPING\r\n$")
+	})
+
+	if e != ErrHandshakeTimeout {
+		t.Errorf("Expected: %#v, got: %#v", ErrHandshakeTimeout, e)
+	}
+}
+
+func TestHandshakeUnexpectedInfo(t *testing.T) {
+	e := testHandshakeScript(t, Handshake{}, func(srv *test.TestServer) {
+		srv.AssertWrite("PING\r\n")
+	})
+
+	pe, ok := e.(*ProtocolError)
+	if !ok {
+		t.Errorf("Expected protocol error, got: %#v", e)
+		return
+	}
+
+	if pe.Expected != "INFO" || pe.Received != "PING" {
+		t.Errorf("Unexpected: %#v", pe)
+	}
+}
+
+func testHandshakeUnexpectedAcknowledgement(t *testing.T, verbose bool, connect, reply, expected string) {
+	e := testHandshakeScript(t, Handshake{Verbose: verbose}, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {}\r\n")
+		srv.AssertMatch(connect)
+		srv.AssertWrite(reply)
+	})
+
+	pe, ok := e.(*ProtocolError)
+	if !ok {
+		t.Errorf("Expected protocol error, got: %#v", e)
+		return
+	}
+
+	if pe.Expected != expected || pe.Received+"\r\n" != reply {
+		t.Errorf("Unexpected: %#v", pe)
+	}
+}
+
+func TestHandshakeUnexpectedAcknowledgement(t *testing.T) {
+	testHandshakeUnexpectedAcknowledgement(t, true, "^CONNECT .*\r\n$", "PONG\r\n", "+OK or -ERR")
+}
+
+// A server that isn't verbose doesn't acknowledge CONNECT
+func TestHandshakeUnexpectedAcknowledgementWhenNotVerbose(t *testing.T) {
+	testHandshakeUnexpectedAcknowledgement(t, false, "^CONNECT .*\r\nPING\r\n$", "+OK\r\n", "PONG or -ERR")
+}
+
+func TestHandshakeAuthenticationFailure(t *testing.T) {
+	e := testHandshakeScript(t, Handshake{}, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {}\r\n")
+		srv.AssertMatch("^CONNECT .*\r\nPING\r\n$")
+		srv.AssertWrite("-ERR 'Authorization Violation'\r\n")
+	})
+
+	if e != ErrAuthenticationFailure {
+		t.Errorf("Expected: %#v, got: %#v", ErrAuthenticationFailure, e)
+	}
+}
+
+func TestHandshakeWithConnectOptions(t *testing.T) {
+	h := Handshake{
+		AuthToken: "t0k3n",
+		Name:      "app",
+		NoEcho:    true,
+	}
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {}\r\n")
+		srv.AssertRead("CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":\"\",\"pass\":\"\"," +
+			"\"auth_token\":\"t0k3n\",\"name\":\"app\",\"echo\":false}\r\nPING\r\n")
+		srv.AssertWrite("PONG\r\n")
+	})
+
+	if e != nil {
+		t.Error(e)
+	}
+}
+
+func TestHandshakeWithHeaders(t *testing.T) {
+	h := Handshake{
+		Headers: true,
+	}
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {\"headers\":true}\r\n")
+		srv.AssertRead("CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":\"\",\"pass\":\"\",\"headers\":true}\r\nPING\r\n")
+		srv.AssertWrite("PONG\r\n")
+	})
+
+	if e != nil {
+		t.Error(e)
+	}
+}
+
+func TestHandshakeWithHeadersUnsupported(t *testing.T) {
+	h := Handshake{
+		Headers: true,
+	}
+
+	e := testHandshakeScript(t, h, func(srv *test.TestServer) {
+		srv.AssertWrite("INFO {}\r\n")
+		srv.AssertRead("CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":\"\",\"pass\":\"\"}\r\nPING\r\n")
+		srv.AssertWrite("PONG\r\n")
+	})
+
+	if e != nil {
+		t.Error(e)
+	}
+}
+
+func TestHandshakeReturnsServerInfo(t *testing.T) {
+	c, s := net.Pipe()
+	srv := test.NewTestServer(t, s)
+	ic := make(chan *ServerInfo, 1)
+
+	go func() {
+		_, info, e := Handshake{}.Handshake(c)
+		if e != nil {
+			t.Error(e)
+		}
+
+		ic <- info
+	}()
+
+	srv.AssertWrite("INFO {\"server_id\":\"id\",\"version\":\"2.0.0\",\"max_payload\":1024}\r\n")
+	acceptConnect(srv, false)
+
+	info := <-ic
+	expected := &ServerInfo{ServerId: "id", Version: "2.0.0", MaxPayload: 1024}
+	if !reflect.DeepEqual(expected, info) {
+		t.Errorf("Expected: %#v, got: %#v", expected, info)
+	}
+}
+
+func TestHandshakeReturnsNegotiatedHeaders(t *testing.T) {
+	for _, headers := range []bool{false, true} {
+		c, s := net.Pipe()
+		srv := test.NewTestServer(t, s)
+		ic := make(chan *ServerInfo, 1)
+
+		go func() {
+			_, info, e := Handshake{Headers: headers}.Handshake(c)
+			if e != nil {
+				t.Error(e)
+			}
+
+			ic <- info
+		}()
+
+		srv.AssertWrite("INFO {\"headers\":true}\r\n")
+		acceptConnect(srv, false)
+
+		if info := <-ic; info == nil || info.Headers != headers {
+			t.Errorf("Expected headers %v, got: %#v", headers, info)
+		}
+	}
+}
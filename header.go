@@ -0,0 +1,124 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidHeader = errors.New("nats: invalid header")
+)
+
+// Version line that starts every header block
+const headerVersion = "NATS/1.0"
+
+// Metadata sent along with a message, such as trace IDs or content types.
+// Keys are case sensitive.
+type Header map[string][]string
+
+func (h Header) Add(key, value string) {
+	h[key] = append(h[key], value)
+}
+
+func (h Header) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+// First value of key, or the empty string
+func (h Header) Get(key string) string {
+	var v = h[key]
+	if len(v) == 0 {
+		return ""
+	}
+
+	return v[0]
+}
+
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// Check every key and value can be encoded
+func (h Header) validate() error {
+	for k, vs := range h {
+		if k == "" || strings.ContainsAny(k, ": \t\r\n") {
+			return ErrInvalidHeader
+		}
+
+		for _, v := range vs {
+			if strings.ContainsAny(v, "\r\n") {
+				return ErrInvalidHeader
+			}
+		}
+	}
+
+	return nil
+}
+
+// Encode header block, terminated by an empty line
+func (h Header) encode() ([]byte, error) {
+	if e := h.validate(); e != nil {
+		return nil, e
+	}
+
+	var buf bytes.Buffer
+	var keys = make([]string, 0, len(h))
+
+	for k := range h {
+		keys = append(keys, k)
+	}
+
+	// Deterministic output
+	sort.Strings(keys)
+
+	buf.WriteString(headerVersion)
+	buf.WriteString("\r\n")
+
+	for _, k := range keys {
+		for _, v := range h[k] {
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			buf.WriteString(v)
+			buf.WriteString("\r\n")
+		}
+	}
+
+	buf.WriteString("\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// Decode header block as written by encode
+func decodeHeader(b []byte) (Header, error) {
+	var lines [][]byte
+
+	// The block ends with an empty line
+	if !bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	lines = bytes.Split(b[:len(b)-4], []byte("\r\n"))
+
+	// The version may be followed by a status code and description
+	if !bytes.HasPrefix(lines[0], []byte(headerVersion)) {
+		return nil, ErrInvalidHeader
+	}
+
+	var h = make(Header)
+
+	for _, line := range lines[1:] {
+		var i = bytes.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, ErrInvalidHeader
+		}
+
+		var k = string(line[:i])
+		var v = string(bytes.TrimSpace(line[i+1:]))
+
+		h.Add(k, v)
+	}
+
+	return h, nil
+}
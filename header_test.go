@@ -0,0 +1,72 @@
+package nats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeaderEncode(t *testing.T) {
+	var h = make(Header)
+
+	h.Set("B", "2")
+	h.Add("A", "1")
+	h.Add("A", "one")
+
+	b, err := h.encode()
+	if err != nil {
+		t.Errorf("Error: %#v", err)
+		return
+	}
+
+	var expected = "NATS/1.0\r\nA: 1\r\nA: one\r\nB: 2\r\n\r\n"
+	if string(b) != expected {
+		t.Errorf("Expected: %#v, got: %#v", expected, string(b))
+	}
+}
+
+func TestHeaderEncodeInvalid(t *testing.T) {
+	var invalid = []Header{
+		{"": {"v"}},
+		{"a b": {"v"}},
+		{"a:b": {"v"}},
+		{"k": {"v\r\nX: injected"}},
+	}
+
+	for _, h := range invalid {
+		if _, err := h.encode(); err != ErrInvalidHeader {
+			t.Errorf("Expected: %#v, got: %#v", ErrInvalidHeader, err)
+		}
+	}
+}
+
+func TestHeaderDecode(t *testing.T) {
+	h, err := decodeHeader([]byte("NATS/1.0 503\r\nA: 1\r\nA:one\r\n\r\n"))
+	if err != nil {
+		t.Errorf("Error: %#v", err)
+		return
+	}
+
+	var expected = Header{"A": {"1", "one"}}
+	if !reflect.DeepEqual(expected, h) {
+		t.Errorf("Expected: %#v, got: %#v", expected, h)
+	}
+
+	if h.Get("A") != "1" || h.Get("B") != "" {
+		t.Errorf("Unexpected Get: %#v", h)
+	}
+}
+
+func TestHeaderDecodeInvalid(t *testing.T) {
+	var invalid = []string{
+		"",
+		"NATS/1.0\r\n",
+		"HTTP/1.1\r\n\r\n",
+		"NATS/1.0\r\nno colon\r\n\r\n",
+	}
+
+	for _, b := range invalid {
+		if _, err := decodeHeader([]byte(b)); err != ErrInvalidHeader {
+			t.Errorf("Expected: %#v, got: %#v for %#v", ErrInvalidHeader, err, b)
+		}
+	}
+}
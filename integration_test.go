@@ -0,0 +1,779 @@
+package nats
+
+import (
+	"bytes"
+	"github.com/cloudfoundry/gonats/test"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Dialer that connects to an in-process server through net.Pipe
+type pipeDialer struct {
+	s *test.Server
+}
+
+func (d pipeDialer) Dial() (net.Conn, error) {
+	return d.s.Pipe(), nil
+}
+
+type integrationClient struct {
+	*Client
+
+	// Receives the return value of Run
+	ec chan error
+}
+
+func startClient(d Dialer, h Handshaker) *integrationClient {
+	var ic = &integrationClient{NewClient(), make(chan error, 1)}
+
+	go func() {
+		ic.ec <- ic.Run(d, h)
+	}()
+
+	return ic
+}
+
+func (ic *integrationClient) Stop() {
+	ic.Client.Stop()
+	<-ic.ec
+}
+
+// Subscribe, and make sure the server knows about it before returning
+func (ic *integrationClient) subscribe(subject, queue string) *Subscription {
+	sub := ic.NewSubscription(subject)
+	sub.SetQueue(queue)
+	sub.Subscribe()
+
+	ic.Ping()
+
+	return sub
+}
+
+func receive(t *testing.T, sub *Subscription) *readMessage {
+	select {
+	case m := <-sub.Inbox:
+		return m
+	case <-time.After(time.Second):
+		t.Errorf("Expected message on %s", sub.Subject())
+	}
+
+	return nil
+}
+
+func TestIntegrationPublishSubscribe(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, EmptyHandshake)
+	b := startClient(pipeDialer{s}, DefaultHandshaker("", ""))
+
+	exact := a.subscribe("foo.bar", "")
+	single := a.subscribe("foo.*", "")
+	full := a.subscribe("foo.>", "")
+	other := a.subscribe("foo.baz", "")
+
+	b.Publish("foo.bar", []byte("hi"))
+
+	// Deliveries to the subscriptions may come in any order
+	var mc = make(chan *readMessage, 3)
+	for _, sub := range []*Subscription{exact, single, full} {
+		go func(sub *Subscription) {
+			mc <- receive(t, sub)
+		}(sub)
+	}
+
+	for i := 0; i < 3; i++ {
+		if m := <-mc; m == nil || string(m.Payload) != "hi" {
+			t.Errorf("Expected hi, got %#v", m)
+		}
+	}
+
+	select {
+	case m := <-other.Inbox:
+		t.Errorf("Expected no message, got %#v", m)
+	default:
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationQueueGroup(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, EmptyHandshake)
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+	p := startClient(pipeDialer{s}, EmptyHandshake)
+
+	subs := []*Subscription{a.subscribe("work", "workers"), b.subscribe("work", "workers")}
+
+	var lock sync.Mutex
+	var received []string
+	var wg sync.WaitGroup
+
+	for _, sub := range subs {
+		wg.Add(1)
+		go func(sub *Subscription) {
+			defer wg.Done()
+
+			for m := range sub.Inbox {
+				lock.Lock()
+				received = append(received, string(m.Payload))
+				lock.Unlock()
+			}
+		}(sub)
+	}
+
+	for _, m := range []string{"1", "2", "3", "4"} {
+		p.Publish("work", []byte(m))
+	}
+
+	// Every message is delivered once
+	for i := 0; i < 1000; i++ {
+		lock.Lock()
+		n := len(received)
+		lock.Unlock()
+
+		if n >= 4 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	a.Stop()
+	b.Stop()
+	p.Stop()
+	wg.Wait()
+
+	sort.Strings(received)
+	if len(received) != 4 || received[0] != "1" || received[3] != "4" {
+		t.Errorf("Expected every message once, got %#v", received)
+	}
+}
+
+// A queue name shared by subscriptions to different subjects makes
+// different groups
+func TestIntegrationQueueGroupPerSubject(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, EmptyHandshake)
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	wildcard := a.subscribe("work.*", "workers")
+	exact := b.subscribe("work.a", "workers")
+
+	if n := s.Interest("work.a"); n != 2 {
+		t.Errorf("Expected two groups, got %d", n)
+	}
+
+	b.Publish("work.a", []byte("hi"))
+
+	for _, sub := range []*Subscription{wildcard, exact} {
+		if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+			t.Errorf("Expected hi on %s, got %#v", sub.Subject(), m)
+		}
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationMaximum(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := a.NewSubscription("foo")
+	sub.SetMaximum(2)
+	sub.Subscribe()
+	a.Ping()
+
+	for _, m := range []string{"1", "2", "3"} {
+		a.Publish("foo", []byte(m))
+	}
+
+	var n int
+	for range sub.Inbox {
+		n++
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 messages, got %d", n)
+	}
+
+	a.Stop()
+}
+
+func TestIntegrationHeadersAndNoEcho(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	var h = DefaultHandshaker("", "").(Handshake)
+	h.NoEcho = true
+
+	a := startClient(pipeDialer{s}, h)
+	b := startClient(pipeDialer{s}, DefaultHandshaker("", ""))
+
+	own := a.subscribe("foo", "")
+	other := b.subscribe("foo", "")
+
+	var header = Header{}
+	header.Set("Key", "value")
+
+	if !a.PublishWithHeader("foo", header, []byte("hi")) {
+		t.Fatal("Expected publish to succeed")
+	}
+
+	m := receive(t, other)
+	if m == nil || m.Header.Get("Key") != "value" || string(m.Payload) != "hi" {
+		t.Errorf("Expected header and payload, got %#v", m)
+	}
+
+	// Round trip so the message would have been delivered
+	a.Ping()
+
+	select {
+	case m := <-own.Inbox:
+		t.Errorf("Expected no echo, got %#v", m)
+	default:
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationLogsFailedHandshakeOnce(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	s.Username = "user"
+	s.Password = "pass"
+
+	var tl testLogger
+
+	var h = DefaultHandshaker("user", "wrong").(Handshake)
+	h.Logger = &tl
+
+	c := NewClient()
+	c.Logger = &tl
+
+	if e := c.Run(pipeDialer{s}, h); e != ErrAuthenticationFailure {
+		t.Errorf("Expected ErrAuthenticationFailure, got %#v", e)
+	}
+
+	var n int
+	for _, m := range tl.Messages() {
+		if m == "handshake failed" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		t.Errorf("Expected the failure to be logged once, got: %#v", tl.Messages())
+	}
+}
+
+func TestIntegrationHeadersStrippedWithoutNegotiation(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, DefaultHandshaker("", ""))
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := b.subscribe("foo", "")
+
+	var header = Header{}
+	header.Set("Key", "value")
+
+	if !a.PublishWithHeader("foo", header, []byte("hi")) {
+		t.Fatal("Expected publish to succeed")
+	}
+
+	m := receive(t, sub)
+	if m == nil || m.Header != nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected only the payload, got %#v", m)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationAuthentication(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	s.Username = "user"
+	s.Password = "pass"
+
+	bad := startClient(pipeDialer{s}, DefaultHandshaker("user", "wrong"))
+	if e := <-bad.ec; e != ErrAuthenticationFailure {
+		t.Errorf("Expected ErrAuthenticationFailure, got %#v", e)
+	}
+
+	good := startClient(pipeDialer{s}, DefaultHandshaker("user", "pass"))
+	if !good.Ping() {
+		t.Errorf("Expected to be connected")
+	}
+
+	if n := s.NumClients(); n != 1 {
+		t.Errorf("Expected 1 client, got %d", n)
+	}
+
+	good.Stop()
+}
+
+func TestIntegrationTLSOverLoopback(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	s.TLSRequired = true
+
+	addr, e := s.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var h = DefaultHandshaker("", "").(Handshake)
+	h.TLSPinnedCertificates = [][]byte{test.CertificateFingerprint()}
+
+	a := startClient(DefaultDialer(addr), h)
+
+	sub := a.subscribe("foo", "")
+	a.Publish("foo", []byte("hi"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	a.Stop()
+}
+
+func TestIntegrationTLSVerifiedOverLoopback(t *testing.T) {
+	ca, e := test.NewCA()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cert, e := ca.Issue(test.CertOptions{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var s = test.NewServer()
+	defer s.Close()
+
+	s.TLSRequired = true
+	s.TLSConfig = ca.ServerConfig(cert, false)
+
+	addr, e := s.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// The certificate is verified against the dialed address
+	var h = DefaultHandshaker("", "").(Handshake)
+	h.TLSConfig = ca.ClientConfig("")
+
+	a := startClient(DefaultDialer(addr), h)
+
+	sub := a.subscribe("foo", "")
+	a.Publish("foo", []byte("hi"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	a.Stop()
+}
+
+func TestIntegrationRequestValue(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	a := startClient(pipeDialer{s}, EmptyHandshake)
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := b.subscribe("double", "")
+
+	go func() {
+		for m := range sub.Inbox {
+			b.Publish(string(m.ReplyTo), append(m.Payload, m.Payload...))
+		}
+	}()
+
+	ec, _ := NewEncodedClient(a.Client, RawCodec)
+
+	var resp string
+	e := ec.RequestValue("double", "ab", &resp, time.Second)
+	if e != nil || resp != "abab" {
+		t.Errorf("Expected abab, got %#v, %#v", resp, e)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+// Wait until the dialer made n connections
+func waitForDials(t *testing.T, d *test.FaultDialer, n int) bool {
+	for i := 0; i < 1000; i++ {
+		if len(d.Conns()) >= n {
+			return true
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Errorf("Expected %d connections, got %d", n, len(d.Conns()))
+
+	return false
+}
+
+func TestIntegrationFragmentedReads(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	d := &test.FaultDialer{Upstream: pipeDialer{s}}
+	d.Configure = func(i int, f *test.FaultConn) {
+		f.SetReadChunk(1)
+	}
+
+	a := startClient(d, EmptyHandshake)
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := a.subscribe("foo", "")
+	b.Publish("foo", []byte("fragmented"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "fragmented" {
+		t.Errorf("Expected fragmented, got %#v", m)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationReconnectAfterWriteError(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	// The first write on the first connection fails
+	d := &test.FaultDialer{Upstream: pipeDialer{s}}
+	d.Configure = func(i int, f *test.FaultConn) {
+		if i == 0 {
+			f.FailWriteAfter(0, nil)
+		}
+	}
+
+	a := startClient(d, EmptyHandshake)
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := a.NewSubscription("foo")
+	sub.Subscribe()
+
+	if waitForDials(t, d, 2) && !a.Ping() {
+		t.Errorf("Expected to be connected")
+	}
+
+	b.Publish("foo", []byte("hi"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationReconnectWhenBlackholed(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	// The first connection goes dark without closing
+	d := &test.FaultDialer{Upstream: pipeDialer{s}}
+	d.Configure = func(i int, f *test.FaultConn) {
+		if i == 0 {
+			f.Blackhole()
+		}
+	}
+
+	var ic = &integrationClient{NewClient(), make(chan error, 1)}
+	ic.PingInterval = 10 * time.Millisecond
+	ic.MaxPingsOutstanding = 1
+
+	go func() {
+		ic.ec <- ic.Run(d, EmptyHandshake)
+	}()
+
+	if waitForDials(t, d, 2) && !ic.Ping() {
+		t.Errorf("Expected to be connected")
+	}
+
+	ic.Stop()
+}
+
+// Commands a session sends, including what a reconnect resends, are
+// compared against testdata/session.golden; run with GONATS_UPDATE_GOLDEN=1
+// after intended changes
+func TestIntegrationGoldenSession(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	s.ServerId = "golden"
+
+	var tr = test.NewTranscript()
+	var d = test.RecordingDialer{Upstream: pipeDialer{s}, Transcript: tr}
+
+	// Not verbose, so acknowledgements don't interleave with commands. The
+	// password is redacted in the transcript.
+	a := startClient(d, Handshake{Headers: true, Username: "golden", Password: "secret"})
+	b := startClient(pipeDialer{s}, EmptyHandshake)
+
+	foo := a.subscribe("foo", "")
+	a.subscribe("bar", "workers")
+
+	baz := a.NewSubscription("baz")
+	baz.SetMaximum(2)
+	baz.Subscribe()
+	a.Ping()
+
+	b.Publish("foo", []byte("hi"))
+	receive(t, foo)
+	a.Ping()
+
+	// Subscriptions are restored on the new connection
+	s.CloseConnections()
+	for tr.Connections() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	a.Ping()
+
+	foo.Unsubscribe()
+	a.Ping()
+
+	a.Stop()
+	b.Stop()
+
+	tr.Verify(t, "testdata/session.golden")
+}
+
+func startCluster(t *testing.T, n int) *test.Cluster {
+	var c = test.NewCluster(n)
+
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+
+	return c
+}
+
+func TestClusterRoutesBetweenNodes(t *testing.T) {
+	c := startCluster(t, 3)
+	defer c.Close()
+
+	addrs := c.Addrs()
+
+	a := startClient(DefaultDialer(addrs[0]), Handshake{})
+	b := startClient(DefaultDialer(addrs[1]), Handshake{})
+	p := startClient(DefaultDialer(addrs[2]), Handshake{})
+
+	subs := []*Subscription{a.subscribe("work", "workers"), b.subscribe("work", "workers")}
+	all := a.subscribe("work", "")
+
+	p.Publish("work", []byte("hi"))
+
+	if m := receive(t, all); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	// One member of the group receives it, whichever node it is on
+	select {
+	case <-subs[0].Inbox:
+	case <-subs[1].Inbox:
+	case <-time.After(time.Second):
+		t.Errorf("Expected a queue subscriber to receive the message")
+	}
+
+	a.Stop()
+	b.Stop()
+	p.Stop()
+}
+
+func TestClusterInterestCountsQueueGroupOnce(t *testing.T) {
+	c := startCluster(t, 2)
+	defer c.Close()
+
+	addrs := c.Addrs()
+
+	a := startClient(DefaultDialer(addrs[0]), Handshake{})
+	b := startClient(DefaultDialer(addrs[1]), Handshake{})
+
+	a.subscribe("foo", "q")
+	b.subscribe("foo", "q")
+	b.subscribe("foo", "")
+
+	if n := c.Interest("foo"); n != 2 {
+		t.Errorf("Expected 2, got %d", n)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := startCluster(t, 3)
+	defer c.Close()
+
+	addrs := c.Addrs()
+
+	a := startClient(DefaultClusterDialer(addrs...), Handshake{})
+	sub := a.subscribe("foo", "")
+
+	// The dialer starts with the first node
+	c.AssertClients(t, 1, time.Second)
+	if c.Node(0).NumClients() != 1 {
+		t.Fatalf("Expected client on node 0")
+	}
+
+	c.Kill(0)
+	c.AssertInterest(t, "foo", 1, 2*time.Second)
+
+	p := startClient(DefaultDialer(addrs[2]), Handshake{})
+	p.Publish("foo", []byte("hi"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	a.Stop()
+	p.Stop()
+}
+
+func TestClusterRestart(t *testing.T) {
+	c := startCluster(t, 1)
+	defer c.Close()
+
+	a := startClient(DefaultDialer(c.Addrs()[0]), Handshake{})
+	a.subscribe("foo", "")
+
+	if e := c.Restart(0); e != nil {
+		t.Fatal(e)
+	}
+
+	c.AssertInterest(t, "foo", 1, 2*time.Second)
+
+	if id := a.ServerInfo().ServerId; id != "node-0.1" {
+		t.Errorf("Expected node-0.1, got %s", id)
+	}
+
+	a.Stop()
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := startCluster(t, 2)
+	defer c.Close()
+
+	addrs := c.Addrs()
+
+	a := startClient(DefaultDialer(addrs[0]), Handshake{})
+	b := startClient(DefaultDialer(addrs[1]), Handshake{})
+
+	sub := a.subscribe("foo", "")
+
+	c.Partition([]int{1})
+
+	b.Publish("foo", []byte("lost"))
+	b.Ping()
+
+	select {
+	case m := <-sub.Inbox:
+		t.Errorf("Expected no message across the partition, got %#v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.Heal()
+
+	b.Publish("foo", []byte("hi"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "hi" {
+		t.Errorf("Expected hi, got %#v", m)
+	}
+
+	a.Stop()
+	b.Stop()
+}
+
+func TestIntegrationWebSocket(t *testing.T) {
+	var s = test.NewServer()
+	defer s.Close()
+
+	var b = test.NewWebSocketBridge()
+	defer b.Close()
+
+	b.Upstream = pipeDialer{s}
+
+	url, e := b.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	a := startClient(DefaultWebSocketDialer(WebSocketDialer{URL: url}), DefaultHandshaker("", ""))
+	c := startClient(pipeDialer{s}, EmptyHandshake)
+
+	sub := a.subscribe("foo", "")
+	c.Publish("foo", []byte("over websocket"))
+
+	if m := receive(t, sub); m == nil || string(m.Payload) != "over websocket" {
+		t.Errorf("Expected message through the bridge, got %#v", m)
+	}
+
+	a.Stop()
+	c.Stop()
+}
+
+func TestIntegrationWebSocketTLSCompressed(t *testing.T) {
+	ca, e := test.NewCA()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cert, e := ca.Issue(test.CertOptions{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var s = test.NewServer()
+	defer s.Close()
+
+	var b = test.NewWebSocketBridge()
+	defer b.Close()
+
+	b.Upstream = pipeDialer{s}
+	b.TLSConfig = ca.ServerConfig(cert, false)
+	b.Compression = true
+	b.FrameSize = 16
+
+	url, e := b.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var d = WebSocketDialer{URL: url, TLSConfig: ca.ClientConfig(""), Compression: true}
+
+	a := startClient(DefaultWebSocketDialer(d), DefaultHandshaker("", ""))
+
+	sub := a.subscribe("foo", "")
+	a.Publish("foo", bytes.Repeat([]byte("hi "), 1000))
+
+	if m := receive(t, sub); m == nil || len(m.Payload) != 3000 {
+		t.Errorf("Expected message through the bridge, got %#v", m)
+	}
+
+	a.Stop()
+}
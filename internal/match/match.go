@@ -0,0 +1,30 @@
+// Package match matches subjects against wildcard patterns, for the fake
+// client and the test server.
+package match
+
+import (
+	"strings"
+)
+
+// Whether subject matches pattern, where * matches a single token and >
+// matches one or more trailing tokens
+func Subject(pattern, subject string) bool {
+	var p = strings.Split(pattern, ".")
+	var t = strings.Split(subject, ".")
+
+	for i, pt := range p {
+		if pt == ">" {
+			return i < len(t)
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if pt != "*" && pt != t[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
@@ -0,0 +1,31 @@
+package match
+
+import (
+	"testing"
+)
+
+func TestSubject(t *testing.T) {
+	var cases = []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo", "foo.bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo", false},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+	}
+
+	for _, c := range cases {
+		if Subject(c.pattern, c.subject) != c.match {
+			t.Errorf("Expected %s matching %s to be %v", c.pattern, c.subject, c.match)
+		}
+	}
+}
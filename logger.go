@@ -0,0 +1,126 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Receives what the client has to say. Arguments after the message are
+// alternating keys and values, like with log/slog.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+type levelLogger struct {
+	l   Logger
+	min LogLevel
+}
+
+func (l levelLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level >= l.min {
+		l.l.Log(level, msg, keyvals...)
+	}
+}
+
+// Logger that drops everything below min before passing it on to l
+func LevelLogger(l Logger, min LogLevel) Logger {
+	return levelLogger{l, min}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	var sl slog.Level
+
+	switch level {
+	case LogDebug:
+		sl = slog.LevelDebug
+	case LogInfo:
+		sl = slog.LevelInfo
+	case LogWarn:
+		sl = slog.LevelWarn
+	default:
+		sl = slog.LevelError
+	}
+
+	l.l.Log(context.Background(), sl, msg, keyvals...)
+}
+
+// Logger that writes to a log/slog logger, whose handler decides which
+// levels are kept
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// Keys whose values are never logged
+var redactedKeys = map[string]bool{
+	"pass":       true,
+	"password":   true,
+	"auth_token": true,
+	"token":      true,
+}
+
+const redacted = "[REDACTED]"
+
+// Replace secrets in key/value pairs: values of sensitive keys, and
+// passwords in URLs
+func redact(keyvals []interface{}) []interface{} {
+	var r = make([]interface{}, len(keyvals))
+
+	copy(r, keyvals)
+
+	for i := 0; i+1 < len(r); i += 2 {
+		var k, _ = r[i].(string)
+
+		if redactedKeys[strings.ToLower(k)] {
+			r[i+1] = redacted
+			continue
+		}
+
+		if s, ok := r[i+1].(string); ok && strings.Contains(s, "@") {
+			if u, e := url.Parse(s); e == nil && u.User != nil {
+				r[i+1] = u.Redacted()
+			}
+		}
+	}
+
+	return r
+}
+
+// Log to l with secrets redacted; l may be nil
+func logTo(l Logger, level LogLevel, msg string, keyvals ...interface{}) {
+	if l == nil {
+		return
+	}
+
+	l.Log(level, msg, redact(keyvals)...)
+}
@@ -0,0 +1,353 @@
+package nats
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Receives metrics as they are recorded, for forwarding to a monitoring
+// system. Names are dot separated.
+type MetricsSink interface {
+	// Add delta to a counter
+	IncrCounter(name string, delta int64)
+
+	// Set a gauge to value
+	SetGauge(name string, value float64)
+
+	// Remove a gauge that is no longer reported, such as the count of a
+	// subject that dropped out of the top subjects
+	DeleteGauge(name string)
+
+	// Add an observation to a histogram
+	Observe(name string, value float64)
+}
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1,
+	0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type histogram struct {
+	bounds []float64
+
+	// Observations per bucket, the last bucket has no upper bound
+	counts []int64
+
+	count int64
+	sum   float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	var h = new(histogram)
+
+	h.bounds = bounds
+	h.counts = make([]int64, len(bounds)+1)
+
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	var i = sort.SearchFloat64s(h.bounds, v)
+
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() map[string]interface{} {
+	var buckets = make(map[string]int64)
+	var cumulative int64
+
+	for i, c := range h.counts {
+		cumulative += c
+
+		if i < len(h.bounds) {
+			buckets[strconv.FormatFloat(h.bounds[i], 'g', -1, 64)] = cumulative
+		} else {
+			buckets["+Inf"] = cumulative
+		}
+	}
+
+	return map[string]interface{}{
+		"count":   h.count,
+		"sum":     h.sum,
+		"buckets": buckets,
+	}
+}
+
+// Message count of a subject
+type SubjectCount struct {
+	Subject string
+	Count   int64
+}
+
+// Approximate counts of the most frequent subjects in bounded memory, using
+// the space-saving algorithm: when a new subject arrives and all slots are
+// taken, it replaces the least frequent subject and inherits its count.
+type subjectCounter struct {
+	n int
+	m map[string]int64
+}
+
+func newSubjectCounter(n int) *subjectCounter {
+	var c = new(subjectCounter)
+
+	c.n = n
+	c.m = make(map[string]int64)
+
+	return c
+}
+
+// Count subject, returns its count, zero if nothing is tracked, and the
+// subject it replaced, if any
+func (c *subjectCounter) add(subject string) (int64, string) {
+	var evicted string
+
+	if c.n <= 0 {
+		return 0, ""
+	}
+
+	if _, ok := c.m[subject]; !ok && len(c.m) >= c.n {
+		var min string
+		var minCount int64 = -1
+
+		for s, v := range c.m {
+			if minCount < 0 || v < minCount {
+				min = s
+				minCount = v
+			}
+		}
+
+		delete(c.m, min)
+		c.m[subject] = minCount
+		evicted = min
+	}
+
+	c.m[subject]++
+
+	return c.m[subject], evicted
+}
+
+func (c *subjectCounter) top() []SubjectCount {
+	var r = make([]SubjectCount, 0, len(c.m))
+
+	for s, v := range c.m {
+		r = append(r, SubjectCount{s, v})
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Count != r[j].Count {
+			return r[i].Count > r[j].Count
+		}
+
+		return r[i].Subject < r[j].Subject
+	})
+
+	return r
+}
+
+// Metrics of a client: publish latency, message counts, the most frequent
+// subjects, subscription pending depth, reconnects and round trip time.
+// Everything is kept for expvar and also passed on to a sink, if set.
+type Metrics struct {
+	sync.Mutex
+
+	sink MetricsSink
+
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+	subjects   *subjectCounter
+}
+
+// Metrics tracking the topN most frequent subjects, passing everything on to
+// sink if it isn't nil
+func NewMetrics(topN int, sink MetricsSink) *Metrics {
+	var m = new(Metrics)
+
+	m.sink = sink
+	m.counters = make(map[string]int64)
+	m.gauges = make(map[string]float64)
+	m.histograms = make(map[string]*histogram)
+	m.subjects = newSubjectCounter(topN)
+
+	return m
+}
+
+// Expects to be called when the lock is held
+func (m *Metrics) incrCounter(name string, delta int64) {
+	m.counters[name] += delta
+
+	if m.sink != nil {
+		m.sink.IncrCounter(name, delta)
+	}
+}
+
+// Expects to be called when the lock is held
+func (m *Metrics) setGauge(name string, value float64) {
+	m.gauges[name] = value
+
+	if m.sink != nil {
+		m.sink.SetGauge(name, value)
+	}
+}
+
+// Expects to be called when the lock is held
+func (m *Metrics) deleteGauge(name string) {
+	delete(m.gauges, name)
+
+	if m.sink != nil {
+		m.sink.DeleteGauge(name)
+	}
+}
+
+// Expects to be called when the lock is held
+func (m *Metrics) observe(name string, value float64) {
+	var h, ok = m.histograms[name]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.histograms[name] = h
+	}
+
+	h.observe(value)
+
+	if m.sink != nil {
+		m.sink.Observe(name, value)
+	}
+}
+
+// The recording methods below may be called on a nil *Metrics, so the client
+// doesn't need to check whether metrics are enabled.
+
+func (m *Metrics) published(bytes int, latency time.Duration, ok bool) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if !ok {
+		m.incrCounter("publish.errors", 1)
+		return
+	}
+
+	m.incrCounter("publish.messages", 1)
+	m.incrCounter("publish.bytes", int64(bytes))
+	m.observe("publish.latency", latency.Seconds())
+}
+
+func (m *Metrics) received(subject string, bytes int, delivered bool) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.incrCounter("messages.received", 1)
+	m.incrCounter("messages.bytes", int64(bytes))
+
+	if !delivered {
+		m.incrCounter("messages.dropped", 1)
+	}
+
+	// Only the tracked subjects get a gauge of their own, so the number of
+	// gauges stays bounded
+	count, evicted := m.subjects.add(subject)
+	if evicted != "" {
+		m.deleteGauge("messages.subject." + evicted)
+	}
+
+	if count > 0 {
+		m.setGauge("messages.subject."+subject, float64(count))
+	}
+}
+
+func (m *Metrics) subscriptions(active int, pending int) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.setGauge("subscriptions.active", float64(active))
+	m.setGauge("subscriptions.pending", float64(pending))
+}
+
+func (m *Metrics) reconnected() {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.incrCounter("reconnects", 1)
+}
+
+func (m *Metrics) rtt(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.setGauge("rtt", d.Seconds())
+	m.observe("rtt.histogram", d.Seconds())
+}
+
+// Most frequent subjects, most frequent first
+func (m *Metrics) TopSubjects() []SubjectCount {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.subjects.top()
+}
+
+// Current values of all metrics, as published to expvar
+func (m *Metrics) Snapshot() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	var counters = make(map[string]int64)
+	for k, v := range m.counters {
+		counters[k] = v
+	}
+
+	var gauges = make(map[string]float64)
+	for k, v := range m.gauges {
+		gauges[k] = v
+	}
+
+	var histograms = make(map[string]interface{})
+	for k, h := range m.histograms {
+		histograms[k] = h.snapshot()
+	}
+
+	var subjects = make(map[string]int64)
+	for _, sc := range m.subjects.top() {
+		subjects[sc.Subject] = sc.Count
+	}
+
+	return map[string]interface{}{
+		"counters":   counters,
+		"gauges":     gauges,
+		"histograms": histograms,
+		"subjects":   subjects,
+	}
+}
+
+// Publish the snapshot as an expvar variable; panics if name is taken, like
+// expvar.Publish
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Snapshot()
+	}))
+}
@@ -0,0 +1,363 @@
+package nats
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/cloudfoundry/gonats/test"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sink that records everything
+type testSink struct {
+	sync.Mutex
+	counters     map[string]int64
+	gauges       map[string]float64
+	observations map[string][]float64
+}
+
+func newTestSink() *testSink {
+	var s = new(testSink)
+
+	s.counters = make(map[string]int64)
+	s.gauges = make(map[string]float64)
+	s.observations = make(map[string][]float64)
+
+	return s
+}
+
+func (s *testSink) IncrCounter(name string, delta int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.counters[name] += delta
+}
+
+func (s *testSink) SetGauge(name string, value float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.gauges[name] = value
+}
+
+func (s *testSink) DeleteGauge(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.gauges, name)
+}
+
+func (s *testSink) Observe(name string, value float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.observations[name] = append(s.observations[name], value)
+}
+
+func (s *testSink) Gauge(name string) float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.gauges[name]
+}
+
+func (s *testSink) Counter(name string) int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.counters[name]
+}
+
+func TestSubjectCounterKeepsTopN(t *testing.T) {
+	var c = newSubjectCounter(2)
+
+	for i := 0; i < 5; i++ {
+		c.add("a")
+	}
+
+	for i := 0; i < 3; i++ {
+		c.add("b")
+	}
+
+	count, evicted := c.add("c")
+	if evicted != "b" {
+		t.Errorf("Expected b to be evicted, got %#v", evicted)
+	}
+
+	// Inherits the count of the subject it replaced
+	if count != 4 {
+		t.Errorf("Expected count 4, got %d", count)
+	}
+
+	var expected = []SubjectCount{{"a", 5}, {"c", 4}}
+	if got := c.top(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, got)
+	}
+}
+
+func TestSubjectCounterDisabled(t *testing.T) {
+	var c = newSubjectCounter(0)
+
+	if count, _ := c.add("a"); count != 0 {
+		t.Errorf("Expected nothing to be tracked, got %d", count)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h = newHistogram([]float64{1, 2})
+
+	h.observe(0.5)
+	h.observe(1)
+	h.observe(1.5)
+	h.observe(3)
+
+	var s = h.snapshot()
+
+	var expected = map[string]int64{"1": 2, "2": 3, "+Inf": 4}
+	if !reflect.DeepEqual(s["buckets"], expected) {
+		t.Errorf("Expected %#v, got %#v", expected, s["buckets"])
+	}
+
+	if s["count"] != int64(4) || s["sum"] != 6.0 {
+		t.Errorf("Expected count 4 and sum 6, got %#v", s)
+	}
+}
+
+func TestMetricsForwardsToSink(t *testing.T) {
+	var s = newTestSink()
+	var m = NewMetrics(1, s)
+
+	m.published(7, time.Millisecond, true)
+	m.published(7, 0, false)
+	m.received("a", 2, true)
+	m.received("a", 2, false)
+	m.received("b", 2, true)
+	m.reconnected()
+	m.rtt(time.Millisecond)
+
+	var counters = map[string]int64{
+		"publish.messages":  1,
+		"publish.bytes":     7,
+		"publish.errors":    1,
+		"messages.received": 3,
+		"messages.bytes":    6,
+		"messages.dropped":  1,
+		"reconnects":        1,
+	}
+
+	if !reflect.DeepEqual(s.counters, counters) {
+		t.Errorf("Expected %#v, got %#v", counters, s.counters)
+	}
+
+	if len(s.observations["publish.latency"]) != 1 {
+		t.Errorf("Expected one latency observation, got %#v", s.observations)
+	}
+
+	if s.gauges["rtt"] != 0.001 {
+		t.Errorf("Expected rtt gauge, got %#v", s.gauges)
+	}
+
+	// Only the tracked subject is left in the snapshot
+	var gauges = m.Snapshot()["gauges"].(map[string]float64)
+
+	if _, ok := gauges["messages.subject.a"]; ok {
+		t.Errorf("Expected evicted subject to be removed, got %#v", gauges)
+	}
+
+	if gauges["messages.subject.b"] != 3 {
+		t.Errorf("Expected gauge for subject b, got %#v", gauges)
+	}
+
+	// And in the sink
+	if _, ok := s.gauges["messages.subject.a"]; ok {
+		t.Errorf("Expected evicted subject to be removed from the sink, got %#v", s.gauges)
+	}
+
+	if s.gauges["messages.subject.b"] != 3 {
+		t.Errorf("Expected gauge for subject b in the sink, got %#v", s.gauges)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+
+	// Shouldn't panic
+	m.published(1, 0, true)
+	m.received("a", 1, true)
+	m.subscriptions(1, 0)
+	m.reconnected()
+	m.rtt(0)
+}
+
+// Metrics published to expvar, which can only be done once per name
+var (
+	expvarMetrics     = NewMetrics(10, nil)
+	expvarMetricsOnce sync.Once
+)
+
+func TestMetricsPublish(t *testing.T) {
+	expvarMetricsOnce.Do(func() {
+		expvarMetrics.Publish("nats_test_metrics")
+		expvarMetrics.received("a", 1, true)
+	})
+
+	var v map[string]map[string]interface{}
+
+	e := json.Unmarshal([]byte(expvar.Get("nats_test_metrics").String()), &v)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if v["subjects"]["a"] != 1.0 {
+		t.Errorf("Expected subject count in expvar, got %#v", v)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	var tc testClient
+	var s = newTestSink()
+
+	c := NewClient()
+	c.Metrics = NewMetrics(10, s)
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	tc.Add(1)
+	go func() {
+		tc.c.Publish("subject", []byte("message"))
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PUB subject 7\r\nmessage\r\n")
+
+	tc.Add(1)
+	go func() {
+		tc.c.RTT()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	tc.s.AssertWrite("MSG subject 1 2\r\nhi\r\n")
+
+	// Round trip so the message is handled first
+	tc.Add(1)
+	go func() {
+		tc.c.Ping()
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("PING\r\n")
+	tc.s.AssertWrite("PONG\r\n")
+
+	tc.Teardown()
+
+	if s.Counter("publish.messages") != 1 {
+		t.Errorf("Expected publish to be counted")
+	}
+
+	// Messages are handled on their own goroutine
+	for i := 0; i < 1000 && s.Counter("messages.received") == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s.Counter("messages.received") != 1 || s.Counter("messages.dropped") != 1 {
+		t.Errorf("Expected dropped message to be counted, got %#v", s.counters)
+	}
+
+	var snapshot = c.Metrics.Snapshot()
+	if _, ok := snapshot["gauges"].(map[string]float64)["rtt"]; !ok {
+		t.Errorf("Expected rtt gauge, got %#v", snapshot)
+	}
+}
+
+func TestClientMetricsPending(t *testing.T) {
+	var tc testClient
+	var s = newTestSink()
+
+	c := NewClient()
+	c.Metrics = NewMetrics(10, s)
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	var sc = make(chan *Subscription, 1)
+
+	tc.Add(1)
+	go func() {
+		sub := tc.c.NewSubscription("subject")
+		sub.Subscribe()
+		sc <- sub
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+	tc.s.AssertWrite("MSG subject 1 2\r\nhi\r\n")
+
+	sub := <-sc
+
+	// Pending until the subscriber receives it
+	test.WaitFor(t, time.Second, "pending message", func() bool {
+		return s.Gauge("subscriptions.pending") == 1
+	})
+
+	<-sub.Inbox
+
+	test.WaitFor(t, time.Second, "no pending message", func() bool {
+		return s.Gauge("subscriptions.pending") == 0
+	})
+
+	if s.Gauge("subscriptions.active") != 1 {
+		t.Errorf("Expected one active subscription, got %#v", s.gauges)
+	}
+
+	tc.Teardown()
+}
+
+func TestClientMetricsPendingBuffered(t *testing.T) {
+	var tc testClient
+	var s = newTestSink()
+
+	c := NewClient()
+	c.Metrics = NewMetrics(10, s)
+
+	tc.SetupWith(t, c, EmptyHandshake)
+
+	var sc = make(chan *Subscription, 1)
+
+	tc.Add(1)
+	go func() {
+		sub := tc.c.NewSubscription("subject")
+		sub.SetBuffer(2)
+		sub.Subscribe()
+		sc <- sub
+		tc.Done()
+	}()
+
+	tc.s.AssertRead("SUB subject 1\r\n")
+
+	// Two fit in the inbox, the third waits for room
+	for i := 0; i < 3; i++ {
+		tc.s.AssertWrite("MSG subject 1 2\r\nhi\r\n")
+	}
+
+	sub := <-sc
+
+	test.WaitFor(t, time.Second, "three pending messages", func() bool {
+		return s.Gauge("subscriptions.pending") == 3
+	})
+
+	<-sub.Inbox
+
+	// The third message moved into the inbox
+	test.WaitFor(t, time.Second, "two pending messages", func() bool {
+		return s.Gauge("subscriptions.pending") == 2
+	})
+
+	<-sub.Inbox
+	<-sub.Inbox
+
+	tc.Teardown()
+}
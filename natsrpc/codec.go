@@ -0,0 +1,277 @@
+// Package natsrpc carries net/rpc calls over NATS request/reply.
+//
+// A server codec subscribes to a subject in a queue group, so calls are load
+// balanced over all servers serving that subject:
+//
+//	server := rpc.NewServer()
+//	server.Register(new(Arith))
+//	go server.ServeCodec(natsrpc.NewServerCodec(client, "arith", "arith"))
+//
+// A client codec publishes calls to the subject and receives the replies on
+// an inbox of its own:
+//
+//	c := rpc.NewClientWithCodec(natsrpc.NewClientCodec(client, "arith"))
+//	e := c.Call("Arith.Multiply", args, &reply)
+//
+// Arguments and replies are encoded with encoding/gob, like net/rpc does.
+package natsrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/rpc"
+	"sync"
+
+	"github.com/cloudfoundry/gonats"
+)
+
+var (
+	ErrPublishFailed = errors.New("natsrpc: publish failed")
+	ErrUnknownCall   = errors.New("natsrpc: response to unknown call")
+)
+
+// Message carrying a call
+type request struct {
+	ServiceMethod string
+	Seq           uint64
+	Body          []byte
+}
+
+// Message carrying the result of a call
+type response struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+	Body          []byte
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	e := gob.NewEncoder(&buf).Encode(v)
+	if e != nil {
+		return nil, e
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decode(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// Body of a request or response; net/rpc passes nil to discard it
+func decodeBody(b []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+
+	return decode(b, v)
+}
+
+func newInbox() string {
+	var b [13]byte
+
+	rand.Read(b[:])
+
+	return "_INBOX." + hex.EncodeToString(b[:])
+}
+
+type clientCodec struct {
+	c       nats.Conn
+	subject string
+	sub     *nats.Subscription
+
+	// Body of the response whose header was read last
+	body []byte
+}
+
+// Codec for rpc.Client, publishing calls to subject. Blocks until c is
+// connected.
+func NewClientCodec(c nats.Conn, subject string) rpc.ClientCodec {
+	var cc = new(clientCodec)
+
+	cc.c = c
+	cc.subject = subject
+	cc.sub = c.NewSubscription(newInbox())
+	cc.sub.Subscribe()
+
+	return cc
+}
+
+func (cc *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	var req request
+	var e error
+
+	req.ServiceMethod = r.ServiceMethod
+	req.Seq = r.Seq
+
+	req.Body, e = encode(body)
+	if e != nil {
+		return e
+	}
+
+	m, e := encode(&req)
+	if e != nil {
+		return e
+	}
+
+	if !cc.c.PublishWithReply(cc.subject, cc.sub.Subject(), m) {
+		return ErrPublishFailed
+	}
+
+	return nil
+}
+
+func (cc *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	var resp response
+
+	m, ok := <-cc.sub.Inbox
+	if !ok {
+		return io.EOF
+	}
+
+	e := decode(m.Payload, &resp)
+	if e != nil {
+		return e
+	}
+
+	r.ServiceMethod = resp.ServiceMethod
+	r.Seq = resp.Seq
+	r.Error = resp.Error
+
+	cc.body = resp.Body
+
+	return nil
+}
+
+func (cc *clientCodec) ReadResponseBody(body interface{}) error {
+	var b = cc.body
+
+	cc.body = nil
+
+	return decodeBody(b, body)
+}
+
+func (cc *clientCodec) Close() error {
+	cc.sub.Unsubscribe()
+	return nil
+}
+
+// Where to send the response to a call
+type pendingCall struct {
+	reply string
+	seq   uint64
+}
+
+type serverCodec struct {
+	c   nats.Conn
+	sub *nats.Subscription
+
+	// Calls of different clients may have the same sequence number, so the
+	// server is given sequence numbers of the codec's own
+	seq     uint64
+	pending map[uint64]pendingCall
+	lock    sync.Mutex
+
+	// Body of the request whose header was read last
+	body []byte
+}
+
+// Codec for rpc.Server, serving calls published to subject. Servers with the
+// same queue group share the calls. Blocks until c is connected.
+func NewServerCodec(c nats.Conn, subject, queue string) rpc.ServerCodec {
+	var sc = new(serverCodec)
+
+	sc.c = c
+	sc.pending = make(map[uint64]pendingCall)
+
+	sc.sub = c.NewSubscription(subject)
+	sc.sub.SetQueue(queue)
+	sc.sub.Subscribe()
+
+	return sc
+}
+
+func (sc *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	for m := range sc.sub.Inbox {
+		var req request
+
+		// Nobody to respond to
+		if len(m.ReplyTo) == 0 {
+			continue
+		}
+
+		// Drop calls that aren't ours rather than stopping the server
+		if decode(m.Payload, &req) != nil {
+			continue
+		}
+
+		sc.lock.Lock()
+		sc.seq++
+		sc.pending[sc.seq] = pendingCall{string(m.ReplyTo), req.Seq}
+		r.Seq = sc.seq
+		sc.lock.Unlock()
+
+		r.ServiceMethod = req.ServiceMethod
+		sc.body = req.Body
+
+		return nil
+	}
+
+	return io.EOF
+}
+
+func (sc *serverCodec) ReadRequestBody(body interface{}) error {
+	var b = sc.body
+
+	sc.body = nil
+
+	return decodeBody(b, body)
+}
+
+func (sc *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	var resp response
+	var e error
+
+	sc.lock.Lock()
+	call, ok := sc.pending[r.Seq]
+	delete(sc.pending, r.Seq)
+	sc.lock.Unlock()
+
+	if !ok {
+		return ErrUnknownCall
+	}
+
+	resp.ServiceMethod = r.ServiceMethod
+	resp.Seq = call.seq
+	resp.Error = r.Error
+
+	// Like net/rpc, send no body with errors
+	if r.Error == "" {
+		resp.Body, e = encode(body)
+		if e != nil {
+			return e
+		}
+	}
+
+	m, e := encode(&resp)
+	if e != nil {
+		return e
+	}
+
+	if !sc.c.Publish(call.reply, m) {
+		return ErrPublishFailed
+	}
+
+	return nil
+}
+
+func (sc *serverCodec) Close() error {
+	sc.sub.Unsubscribe()
+	return nil
+}
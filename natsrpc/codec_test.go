@@ -0,0 +1,153 @@
+package natsrpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudfoundry/gonats"
+)
+
+type chanDialer chan net.Conn
+
+func (d chanDialer) Dial() (net.Conn, error) {
+	return <-d, nil
+}
+
+// Routes the client's publishes back to its own subscriptions, so a single
+// client can serve and call
+func route(t *testing.T, n net.Conn) {
+	var r = bufio.NewReader(n)
+	var subs = make(map[string]string)
+
+	for {
+		line, e := r.ReadString('\n')
+		if e != nil {
+			return
+		}
+
+		var f = strings.Fields(line)
+
+		switch f[0] {
+		case "SUB":
+			subs[f[len(f)-1]] = f[1]
+		case "UNSUB":
+			delete(subs, f[1])
+		case "PING":
+			fmt.Fprintf(n, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(f[len(f)-1])
+			payload := make([]byte, size+2)
+
+			if _, e = io.ReadFull(r, payload); e != nil {
+				return
+			}
+
+			var reply string
+			if len(f) == 4 {
+				reply = " " + f[2]
+			}
+
+			for sid, subject := range subs {
+				if subject == f[1] {
+					fmt.Fprintf(n, "MSG %s %s%s %d\r\n%s", f[1], sid, reply, size, payload)
+				}
+			}
+		default:
+			t.Errorf("Unexpected: %#v", line)
+		}
+	}
+}
+
+type Arith int
+
+type Args struct {
+	A, B int
+}
+
+func (a *Arith) Multiply(args *Args, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (a *Arith) Divide(args *Args, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+
+	*reply = args.A / args.B
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	var wg sync.WaitGroup
+	var ncc = make(chan net.Conn)
+	var c = nats.NewClient()
+
+	wg.Add(1)
+	go func() {
+		c.Run(chanDialer(ncc), nats.EmptyHandshake)
+		wg.Done()
+	}()
+
+	nc, ns := net.Pipe()
+	ncc <- nc
+
+	go route(t, ns)
+
+	server := rpc.NewServer()
+	server.Register(new(Arith))
+
+	// Subscribe before calling
+	sc := NewServerCodec(c, "arith", "arith")
+
+	wg.Add(1)
+	go func() {
+		server.ServeCodec(sc)
+		wg.Done()
+	}()
+
+	client := rpc.NewClientWithCodec(NewClientCodec(c, "arith"))
+
+	var reply int
+
+	e := client.Call("Arith.Multiply", &Args{6, 7}, &reply)
+	if e != nil || reply != 42 {
+		t.Errorf("Expected 42, got %d, %#v", reply, e)
+	}
+
+	e = client.Call("Arith.Divide", &Args{1, 0}, &reply)
+	if e == nil || e.Error() != "divide by zero" {
+		t.Errorf("Expected error from the server, got %#v", e)
+	}
+
+	e = client.Call("Arith.Unknown", &Args{}, &reply)
+	if e == nil {
+		t.Errorf("Expected error for unknown method")
+	}
+
+	// Concurrent calls are matched to their replies
+	var calls []*rpc.Call
+	for i := 0; i < 10; i++ {
+		calls = append(calls, client.Go("Arith.Multiply", &Args{i, 2}, new(int), nil))
+	}
+
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil || *call.Reply.(*int) != 2*i {
+			t.Errorf("Expected %d, got %d, %#v", 2*i, *call.Reply.(*int), call.Error)
+		}
+	}
+
+	client.Close()
+
+	c.Stop()
+	wg.Wait()
+}
@@ -10,11 +10,16 @@ import (
 )
 
 var (
-	ErrLineTooLong   = errors.New("reader: line too long")
-	ErrUnknownObject = errors.New("reader: unknown object")
-	ErrInvalidObject = errors.New("reader: invalid object")
+	ErrLineTooLong     = errors.New("reader: line too long")
+	ErrUnknownObject   = errors.New("reader: unknown object")
+	ErrInvalidObject   = errors.New("reader: invalid object")
+	ErrPayloadTooLarge = errors.New("reader: payload too large")
 )
 
+// Largest message payload accepted from a server, so a bogus size can't
+// make the reader allocate without bounds
+const MaxReadPayload = 64 * 1024 * 1024
+
 var (
 	nonSpaceRegexp = regexp.MustCompile("\\S+")
 )
@@ -27,15 +32,29 @@ type readMessage struct {
 	Subscription   []byte
 	SubscriptionId uint
 	ReplyTo        []byte
+	Header         Header
 	Payload        []byte
+
+	// Trace context the message carried, if any
+	Trace TraceContext
 }
 
 func (self *readMessage) read(line []byte, rd *bufio.Reader) (err error) {
 	var chunks [][]byte
+	var headers bool
 
 	chunks = nonSpaceRegexp.FindAll(line, -1)
 
-	if len(chunks) < 4 {
+	// HMSG has the size of the header block before the total size
+	headers = bytes.EqualFold(chunks[0], []byte("hmsg"))
+
+	var sizes = 1
+	if headers {
+		sizes = 2
+	}
+
+	// Subject, sid, optional reply, and the sizes
+	if len(chunks) != 3+sizes && len(chunks) != 4+sizes {
 		return ErrInvalidObject
 	}
 
@@ -52,19 +71,37 @@ func (self *readMessage) read(line []byte, rd *bufio.Reader) (err error) {
 
 	self.SubscriptionId = uint(sid)
 
-	if len(chunks) == 5 {
+	if len(chunks) == 4+sizes {
 		idx += 1
 		self.ReplyTo = make([]byte, len(chunks[idx]))
 		copy(self.ReplyTo, chunks[idx])
 	}
 
+	var headerSize uint64
+
+	if headers {
+		idx += 1
+		headerSize, err = strconv.ParseUint(string(chunks[idx]), 10, 0)
+		if err != nil {
+			return err
+		}
+	}
+
 	idx += 1
-	bytes, err := strconv.ParseUint(string(chunks[idx]), 10, 0)
+	size, err := strconv.ParseUint(string(chunks[idx]), 10, 0)
 	if err != nil {
 		return err
 	}
 
-	self.Payload = make([]byte, bytes+2)
+	if headerSize > size {
+		return ErrInvalidObject
+	}
+
+	if size > MaxReadPayload {
+		return ErrPayloadTooLarge
+	}
+
+	self.Payload = make([]byte, size+2)
 
 	// Read until self.Payload is filled
 	var target []byte = self.Payload
@@ -77,8 +114,19 @@ func (self *readMessage) read(line []byte, rd *bufio.Reader) (err error) {
 		target = target[n:]
 	}
 
-	// Trim to actual payload size, removing CRLF
-	self.Payload = self.Payload[:bytes]
+	if !bytes.Equal(self.Payload[size:], []byte("\r\n")) {
+		return ErrInvalidObject
+	}
+
+	if headers {
+		self.Header, err = decodeHeader(self.Payload[:headerSize])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Trim to actual payload size, removing header and CRLF
+	self.Payload = self.Payload[headerSize:size]
 
 	return
 }
@@ -107,6 +155,25 @@ func (self *readErr) read(line []byte, rd *bufio.Reader) (err error) {
 	return
 }
 
+// Errors the server sends on its own rather than in answer to a command
+var asyncErrors = []string{
+	"'Slow Consumer",
+	"'Stale Connection'",
+	"'Permissions Violation",
+}
+
+// Whether the error answers the command it follows, so it takes the place of
+// its +OK in verbose mode
+func (self *readErr) answersCommand() bool {
+	for _, e := range asyncErrors {
+		if bytes.HasPrefix(self.Payload, []byte(e)) {
+			return false
+		}
+	}
+
+	return true
+}
+
 type readPing struct {
 	// No content
 }
@@ -123,14 +190,22 @@ func (self *readPong) read(line []byte, rd *bufio.Reader) (err error) {
 	return
 }
 
-type readInfo struct {
+// Information the server sends in INFO when a client connects, and again
+// when it changes during the session
+type ServerInfo struct {
 	ServerId     string `json:"server_id"`
 	Version      string `json:"version"`
 	AuthRequired bool   `json:"auth_required"`
 	SslRequired  bool   `json:"ssl_required"`
 	MaxPayload   int64  `json:"max_payload"`
+	Headers      bool   `json:"headers"`
+
+	// Servers in the cluster the client may connect to, as host:port
+	ConnectUrls []string `json:"connect_urls"`
 }
 
+type readInfo ServerInfo
+
 func (self *readInfo) read(line []byte, rd *bufio.Reader) (err error) {
 	var index [][]int
 
@@ -146,6 +221,26 @@ func (self *readInfo) read(line []byte, rd *bufio.Reader) (err error) {
 	return
 }
 
+// Protocol name of an object, for use in error messages
+func objectName(obj readObject) string {
+	switch obj.(type) {
+	case *readMessage:
+		return "MSG"
+	case *readOk:
+		return "+OK"
+	case *readErr:
+		return "-ERR"
+	case *readPing:
+		return "PING"
+	case *readPong:
+		return "PONG"
+	case *readInfo:
+		return "INFO"
+	}
+
+	return "unknown"
+}
+
 func read(rd *bufio.Reader) (readObject, error) {
 	var line []byte
 	var more bool
@@ -165,7 +260,7 @@ func read(rd *bufio.Reader) (readObject, error) {
 	var obj readObject
 
 	switch string(bytes.ToLower(head)) {
-	case "msg":
+	case "msg", "hmsg":
 		obj = new(readMessage)
 	case "+ok":
 		obj = new(readOk)
@@ -2,6 +2,7 @@ package nats
 
 import (
 	"bufio"
+	"bytes"
 	"reflect"
 	"strings"
 	"testing"
@@ -70,6 +71,54 @@ func TestReadMessageWithEarlyEof(t *testing.T) {
 	testReadError(t, "msg sub 1234 12\r\nsome message\r")
 }
 
+func TestReadMessageWithExtraToken(t *testing.T) {
+	testReadError(t, "msg sub 1234 reply extra 12\r\nsome message\r\n")
+	testReadError(t, "hmsg sub 1234 reply extra 12 24\r\nNATS/1.0\r\n\r\nsome message\r\n")
+}
+
+func TestReadMessageWithHugeByteCount(t *testing.T) {
+	var rd = createReader("msg sub 1 18446744073709551615\r\n")
+
+	if _, err := read(rd); err != ErrPayloadTooLarge {
+		t.Errorf("Expected: %#v, got: %#v", ErrPayloadTooLarge, err)
+	}
+}
+
+func TestReadMessageWithoutTrailingCRLF(t *testing.T) {
+	testReadError(t, "msg sub 1234 12\r\nsome messageXX")
+}
+
+func TestReadMessageWithHeader(t *testing.T) {
+	var expected = &readMessage{
+		Subscription:   []byte("sub"),
+		SubscriptionId: 1234,
+		ReplyTo:        []byte("reply"),
+		Header:         Header{"Trace": {"abc"}},
+		Payload:        []byte("some message"),
+	}
+
+	testReadMatch(t, "hmsg sub 1234 reply 24 36\r\nNATS/1.0\r\nTrace: abc\r\n\r\nsome message\r\n", expected)
+}
+
+func TestReadMessageWithHeaderWithoutPayload(t *testing.T) {
+	var expected = &readMessage{
+		Subscription:   []byte("sub"),
+		SubscriptionId: 1234,
+		Header:         Header{},
+		Payload:        []byte{},
+	}
+
+	testReadMatch(t, "hmsg sub 1234 12 12\r\nNATS/1.0\r\n\r\n\r\n", expected)
+}
+
+func TestReadMessageWithHeaderLargerThanMessage(t *testing.T) {
+	testReadError(t, "hmsg sub 1234 13 12\r\nNATS/1.0\r\n\r\n\r\n")
+}
+
+func TestReadMessageWithInvalidHeader(t *testing.T) {
+	testReadError(t, "hmsg sub 1234 4 6\r\nabcdef\r\n")
+}
+
 func TestReadOk(t *testing.T) {
 	var expected = &readOk{}
 
@@ -119,3 +168,99 @@ func TestReadInfo(t *testing.T) {
 
 	testReadMatch(t, "info {\"server_id\":\"some id\" }\r\n", expected)
 }
+
+// The reader may fail on anything a server sends, but must not panic
+func FuzzRead(f *testing.F) {
+	for _, s := range []string{
+		"msg sub 1234 12\r\nsome message\r\n",
+		"msg sub 1234 reply 12\r\nsome message\r\n",
+		"hmsg sub 1 reply 22 24\r\nNATS/1.0\r\nKey: v\r\n\r\nhi\r\n",
+		"hmsg sub 1 12 12\r\nNATS/1.0\r\n\r\n\r\n",
+		"msg sub 1 18446744073709551615\r\n",
+		"+ok\r\n-err 'foo bar'\r\nping\r\npong\r\n",
+		"info {\"server_id\":\"id\",\"connect_urls\":[\"a:1\"]}\r\n",
+	} {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var rd = bufio.NewReader(bytes.NewReader(b))
+
+		for {
+			obj, err := read(rd)
+			if err != nil {
+				break
+			}
+
+			if m, ok := obj.(*readMessage); ok && len(m.Payload) > MaxReadPayload {
+				t.Errorf("Expected payload of at most %d bytes, got %d", MaxReadPayload, len(m.Payload))
+			}
+		}
+	})
+}
+
+// A message published by the writer reads back the same when the server
+// delivers it unchanged
+func FuzzWriteRead(f *testing.F) {
+	f.Add("subject", "", "", "", []byte("message"))
+	f.Add("subject", "reply", "Key", "value", []byte(""))
+	f.Add("a.b.c", "_INBOX.1", "K", "v with spaces", []byte("\r\nmsg x 1 2\r\n"))
+
+	f.Fuzz(func(t *testing.T, subject, reply, key, value string, payload []byte) {
+		// Tokens can't be empty or contain white space
+		if !isToken(subject) || (reply != "" && !isToken(reply)) {
+			return
+		}
+
+		var p = &writePublish{Subject: subject, ReplyTo: reply, Message: payload}
+		if key != "" {
+			p.Header = Header{}
+			p.Header.Set(key, value)
+		}
+
+		var buf bytes.Buffer
+		var wr = bufio.NewWriter(&buf)
+
+		if err := writeAndFlush(wr, p); err != nil {
+			// Header the writer refuses to encode
+			return
+		}
+
+		// The server turns PUB into MSG and adds the subscription id
+		var b = buf.Bytes()
+		var i = bytes.IndexByte(b, ' ')
+		var op = "MSG"
+		if string(b[:i]) == "HPUB" {
+			op = "HMSG"
+		}
+
+		var line = op + " " + subject + " 42" + string(b[i+1+len(subject):])
+
+		obj, err := read(createReader(line))
+		if err != nil {
+			t.Fatalf("Expected no error reading %q, got: %#v", line, err)
+		}
+
+		m, ok := obj.(*readMessage)
+		if !ok {
+			t.Fatalf("Expected message, got: %#v", obj)
+		}
+
+		if string(m.Subscription) != subject || m.SubscriptionId != 42 || string(m.ReplyTo) != reply {
+			t.Errorf("Expected %s 42 %s, got: %#v", subject, reply, m)
+		}
+
+		if !bytes.Equal(m.Payload, payload) {
+			t.Errorf("Expected payload: %q, got: %q", payload, m.Payload)
+		}
+
+		// Values are trimmed when decoded
+		if key != "" && m.Header.Get(key) != strings.TrimSpace(value) {
+			t.Errorf("Expected header %s: %q, got: %#v", key, value, m.Header)
+		}
+	})
+}
+
+func isToken(s string) bool {
+	return len(strings.Fields(s)) == 1 && !strings.ContainsAny(s, " \t\r\n\v\f")
+}
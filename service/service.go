@@ -0,0 +1,449 @@
+// Package service builds request/reply services on a nats.Conn, such as a
+// nats.Client.
+//
+// Endpoints of a service are subscribed in a queue group, so requests are
+// load balanced over all running instances. Every instance also answers the
+// discovery subjects $SRV.PING, $SRV.INFO and $SRV.STATS, optionally followed
+// by the service name and instance id, so operators can list instances and
+// their statistics.
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gonats"
+)
+
+var (
+	ErrInvalidName    = errors.New("service: invalid name")
+	ErrInvalidVersion = errors.New("service: invalid version")
+	ErrInvalidSubject = errors.New("service: invalid subject")
+	ErrEndpointExists = errors.New("service: endpoint already exists")
+	ErrServiceStopped = errors.New("service: stopped")
+	ErrRespondFailed  = errors.New("service: respond failed")
+	ErrNoReplySubject = errors.New("service: request has no reply subject")
+)
+
+// Queue group endpoints are subscribed in if the config doesn't name one
+const DefaultQueueGroup = "q"
+
+// Prefix of the discovery subjects
+const DiscoveryPrefix = "$SRV"
+
+// Headers of error responses
+const (
+	ErrorHeader     = "Nats-Service-Error"
+	ErrorCodeHeader = "Nats-Service-Error-Code"
+)
+
+var (
+	nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// Semantic version, as in semver.org
+	versionRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+		`(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+)
+
+type Config struct {
+	Name        string
+	Version     string
+	Description string
+
+	// Queue group of the endpoints, DefaultQueueGroup when empty
+	QueueGroup string
+
+	// Source of time for the start time and processing times in the stats,
+	// nats.SystemClock when nil
+	Clock nats.Clock
+}
+
+// Handles requests to an endpoint; runs on the endpoint's goroutine, so
+// requests to the same endpoint are handled one at a time
+type Handler func(r *Request)
+
+// Request received by an endpoint
+type Request struct {
+	Subject string
+	Header  nats.Header
+	Data    []byte
+
+	reply string
+	c     nats.Conn
+
+	// Error response, if any
+	err string
+}
+
+// Send data to whoever made the request
+func (r *Request) Respond(data []byte) error {
+	if r.reply == "" {
+		return ErrNoReplySubject
+	}
+
+	if !r.c.Publish(r.reply, data) {
+		return ErrRespondFailed
+	}
+
+	return nil
+}
+
+// Send an error response, which counts as an error in the endpoint stats.
+// The code and description are sent as headers; data is sent alone if the
+// server doesn't support headers.
+func (r *Request) Error(code, description string, data []byte) error {
+	r.err = code + ":" + description
+
+	if r.reply == "" {
+		return ErrNoReplySubject
+	}
+
+	var h = nats.Header{}
+	h.Set(ErrorHeader, description)
+	h.Set(ErrorCodeHeader, code)
+
+	if r.c.PublishWithHeader(r.reply, h, data) {
+		return nil
+	}
+
+	if !r.c.Publish(r.reply, data) {
+		return ErrRespondFailed
+	}
+
+	return nil
+}
+
+// Statistics of an endpoint
+type EndpointStats struct {
+	Name                  string        `json:"name"`
+	Subject               string        `json:"subject"`
+	QueueGroup            string        `json:"queue_group"`
+	NumRequests           int           `json:"num_requests"`
+	NumErrors             int           `json:"num_errors"`
+	LastError             string        `json:"last_error,omitempty"`
+	ProcessingTime        time.Duration `json:"processing_time"`
+	AverageProcessingTime time.Duration `json:"average_processing_time"`
+}
+
+type endpoint struct {
+	sync.Mutex
+	stats EndpointStats
+
+	sub   *nats.Subscription
+	h     Handler
+	clock nats.Clock
+}
+
+func (e *endpoint) handle(r *Request) {
+	var start = e.clock.Now()
+
+	e.h(r)
+
+	var d = e.clock.Now().Sub(start)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.stats.NumRequests++
+	e.stats.ProcessingTime += d
+	e.stats.AverageProcessingTime = e.stats.ProcessingTime / time.Duration(e.stats.NumRequests)
+
+	if r.err != "" {
+		e.stats.NumErrors++
+		e.stats.LastError = r.err
+	}
+}
+
+func (e *endpoint) snapshot() EndpointStats {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.stats
+}
+
+// Identification of an instance, the response to $SRV.PING
+type Ping struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Id      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// Endpoint of an instance, as listed in its info
+type EndpointInfo struct {
+	Name       string `json:"name"`
+	Subject    string `json:"subject"`
+	QueueGroup string `json:"queue_group"`
+}
+
+// Description of an instance, the response to $SRV.INFO
+type Info struct {
+	Ping
+	Description string         `json:"description,omitempty"`
+	Endpoints   []EndpointInfo `json:"endpoints"`
+}
+
+// Statistics of an instance, the response to $SRV.STATS
+type Stats struct {
+	Ping
+	Started   time.Time       `json:"started"`
+	Endpoints []EndpointStats `json:"endpoints"`
+}
+
+// Response types, compatible with other NATS service implementations
+const (
+	PingType  = "io.nats.micro.v1.ping_response"
+	InfoType  = "io.nats.micro.v1.info_response"
+	StatsType = "io.nats.micro.v1.stats_response"
+)
+
+// Running instance of a service
+type Service struct {
+	sync.Mutex
+
+	c       nats.Conn
+	config  Config
+	id      string
+	started time.Time
+	stopped bool
+
+	// Endpoints in the order they were added
+	endpoints []*endpoint
+
+	// Subscriptions to the discovery subjects
+	subs []*nats.Subscription
+}
+
+// Start an instance of a service on c, answering the discovery subjects.
+// Blocks until c is connected.
+func New(c nats.Conn, config Config) (*Service, error) {
+	if !nameRegexp.MatchString(config.Name) {
+		return nil, ErrInvalidName
+	}
+
+	if !versionRegexp.MatchString(config.Version) {
+		return nil, ErrInvalidVersion
+	}
+
+	if config.QueueGroup == "" {
+		config.QueueGroup = DefaultQueueGroup
+	}
+
+	if config.Clock == nil {
+		config.Clock = nats.SystemClock
+	}
+
+	var s = new(Service)
+
+	s.c = c
+	s.config = config
+	s.id = newId()
+	s.started = config.Clock.Now().UTC()
+
+	var verbs = []struct {
+		verb string
+		f    func() interface{}
+	}{
+		{"PING", func() interface{} { return s.Ping() }},
+		{"INFO", func() interface{} { return s.Info() }},
+		{"STATS", func() interface{} { return s.Stats() }},
+	}
+
+	for _, v := range verbs {
+		for _, subject := range discoverySubjects(v.verb, config.Name, s.id) {
+			s.subs = append(s.subs, s.discover(subject, v.f))
+		}
+	}
+
+	return s, nil
+}
+
+func newId() string {
+	var b [11]byte
+
+	rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
+
+// Subjects a verb is answered on: for all services, for all instances of
+// this service, and for this instance alone
+func discoverySubjects(verb, name, id string) []string {
+	var prefix = DiscoveryPrefix + "." + verb
+
+	return []string{prefix, prefix + "." + name, prefix + "." + name + "." + id}
+}
+
+// Answer every request on subject with the JSON encoding of f()
+func (s *Service) discover(subject string, f func() interface{}) *nats.Subscription {
+	var sub = s.c.NewSubscription(subject)
+
+	sub.Subscribe()
+
+	go func() {
+		for m := range sub.Inbox {
+			if len(m.ReplyTo) == 0 {
+				continue
+			}
+
+			b, e := json.Marshal(f())
+			if e != nil {
+				continue
+			}
+
+			s.c.Publish(string(m.ReplyTo), b)
+		}
+	}()
+
+	return sub
+}
+
+// Add an endpoint handling requests on subject, in the service's queue group
+func (s *Service) AddEndpoint(name, subject string, h Handler) error {
+	if !nameRegexp.MatchString(name) {
+		return ErrInvalidName
+	}
+
+	if subject == "" {
+		return ErrInvalidSubject
+	}
+
+	s.Lock()
+
+	if s.stopped {
+		s.Unlock()
+		return ErrServiceStopped
+	}
+
+	for _, e := range s.endpoints {
+		if e.stats.Name == name {
+			s.Unlock()
+			return ErrEndpointExists
+		}
+	}
+
+	var e = new(endpoint)
+
+	e.h = h
+	e.clock = s.config.Clock
+	e.stats.Name = name
+	e.stats.Subject = subject
+	e.stats.QueueGroup = s.config.QueueGroup
+
+	e.sub = s.c.NewSubscription(subject)
+	e.sub.SetQueue(s.config.QueueGroup)
+
+	// Claim the name, then subscribe without the lock: subscribing waits for
+	// the connection, and discovery requests need the lock meanwhile
+	s.endpoints = append(s.endpoints, e)
+	s.Unlock()
+
+	e.sub.Subscribe()
+
+	go func() {
+		for m := range e.sub.Inbox {
+			var r = new(Request)
+
+			r.Subject = string(m.Subscription)
+			r.Header = m.Header
+			r.Data = m.Payload
+			r.reply = string(m.ReplyTo)
+			r.c = s.c
+
+			e.handle(r)
+		}
+	}()
+
+	s.Lock()
+	var stopped = s.stopped
+	s.Unlock()
+
+	// Stop may have missed the subscription
+	if stopped {
+		e.sub.Unsubscribe()
+		return ErrServiceStopped
+	}
+
+	return nil
+}
+
+// Identifier of this instance
+func (s *Service) Id() string {
+	return s.id
+}
+
+func (s *Service) Ping() Ping {
+	return Ping{
+		Type:    PingType,
+		Name:    s.config.Name,
+		Id:      s.id,
+		Version: s.config.Version,
+	}
+}
+
+func (s *Service) Info() Info {
+	s.Lock()
+	defer s.Unlock()
+
+	var info = Info{Ping: s.Ping(), Description: s.config.Description}
+
+	info.Type = InfoType
+	info.Endpoints = []EndpointInfo{}
+
+	for _, e := range s.endpoints {
+		info.Endpoints = append(info.Endpoints, EndpointInfo{
+			Name:       e.stats.Name,
+			Subject:    e.stats.Subject,
+			QueueGroup: e.stats.QueueGroup,
+		})
+	}
+
+	return info
+}
+
+func (s *Service) Stats() Stats {
+	s.Lock()
+	defer s.Unlock()
+
+	var stats = Stats{Ping: s.Ping(), Started: s.started}
+
+	stats.Type = StatsType
+	stats.Endpoints = []EndpointStats{}
+
+	for _, e := range s.endpoints {
+		stats.Endpoints = append(stats.Endpoints, e.snapshot())
+	}
+
+	return stats
+}
+
+// Unsubscribe the endpoints and discovery subjects
+func (s *Service) Stop() {
+	s.Lock()
+
+	if s.stopped {
+		s.Unlock()
+		return
+	}
+
+	s.stopped = true
+
+	var subs = make([]*nats.Subscription, 0, len(s.endpoints)+len(s.subs))
+	for _, e := range s.endpoints {
+		subs = append(subs, e.sub)
+	}
+
+	subs = append(subs, s.subs...)
+
+	// Discovery handlers still running need the lock to answer
+	s.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/gonats"
+	"github.com/cloudfoundry/gonats/test"
+)
+
+type chanDialer chan net.Conn
+
+func (d chanDialer) Dial() (net.Conn, error) {
+	return <-d, nil
+}
+
+// Handshaker for a session that negotiated headers
+type headersHandshake struct{}
+
+func (h headersHandshake) Handshake(n net.Conn) (net.Conn, *nats.ServerInfo, error) {
+	return n, &nats.ServerInfo{Headers: true}, nil
+}
+
+type testService struct {
+	*testing.T
+
+	c *nats.Client
+	s *test.TestServer
+	r *Service
+
+	sync.WaitGroup
+}
+
+// Start a client and a service on it, reading the discovery subscriptions
+func (ts *testService) Setup(t *testing.T, config Config) {
+	var ncc = make(chan net.Conn)
+	var sc = make(chan *Service, 1)
+
+	ts.T = t
+	ts.c = nats.NewClient()
+
+	ts.Add(1)
+	go func() {
+		ts.c.Run(chanDialer(ncc), headersHandshake{})
+		ts.Done()
+	}()
+
+	nc, ns := net.Pipe()
+	ncc <- nc
+	ts.s = test.NewTestServer(t, ns)
+
+	go func() {
+		s, e := New(ts.c, config)
+		if e != nil {
+			t.Error(e)
+		}
+
+		sc <- s
+	}()
+
+	var sid = 1
+	for _, verb := range []string{"PING", "INFO", "STATS"} {
+		ts.s.AssertRead(fmt.Sprintf("SUB $SRV.%s %d\r\n", verb, sid))
+		ts.s.AssertRead(fmt.Sprintf("SUB $SRV.%s.%s %d\r\n", verb, config.Name, sid+1))
+		ts.s.AssertMatch(fmt.Sprintf("SUB \\$SRV\\.%s\\.%s\\.[0-9a-f]{22} %d\r\n", verb, config.Name, sid+2))
+		sid += 3
+	}
+
+	ts.r = <-sc
+}
+
+func (ts *testService) Teardown() {
+	ts.c.Stop()
+	ts.Wait()
+}
+
+// Read a PUB to reply and return its payload
+func (ts *testService) ReadReply(reply string) []byte {
+	var buf = make([]byte, 4096)
+
+	n, e := ts.s.Read(buf)
+	if e != nil {
+		ts.Fatal(e)
+	}
+
+	var re = regexp.MustCompile("^PUB " + regexp.QuoteMeta(reply) + " \\d+\r\n(.*)\r\n$")
+
+	m := re.FindSubmatch(buf[:n])
+	if m == nil {
+		ts.Fatalf("Expected reply on %s, got %#v", reply, string(buf[:n]))
+	}
+
+	return m[1]
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	var c = nats.NewClient()
+
+	if _, e := New(c, Config{Name: "a b", Version: "1.0.0"}); e != ErrInvalidName {
+		t.Errorf("Expected ErrInvalidName, got %#v", e)
+	}
+
+	if _, e := New(c, Config{Name: "a", Version: "1.0"}); e != ErrInvalidVersion {
+		t.Errorf("Expected ErrInvalidVersion, got %#v", e)
+	}
+}
+
+func TestServiceEndpoint(t *testing.T) {
+	var ts testService
+
+	ts.Setup(t, Config{Name: "echo", Version: "1.0.0"})
+
+	ts.Add(1)
+	go func() {
+		e := ts.r.AddEndpoint("echo", "svc.echo", func(r *Request) {
+			if string(r.Data) == "fail" {
+				r.Error("400", "bad request", nil)
+				return
+			}
+
+			r.Respond(r.Data)
+		})
+
+		if e != nil {
+			t.Error(e)
+		}
+
+		if e = ts.r.AddEndpoint("echo", "svc.other", nil); e != ErrEndpointExists {
+			t.Errorf("Expected ErrEndpointExists, got %#v", e)
+		}
+
+		ts.Done()
+	}()
+
+	// Load balanced over the instances
+	ts.s.AssertRead("SUB svc.echo q 10\r\n")
+
+	ts.s.AssertWrite("MSG svc.echo 10 reply.1 2\r\nhi\r\n")
+	ts.s.AssertRead("PUB reply.1 2\r\nhi\r\n")
+
+	ts.s.AssertWrite("MSG svc.echo 10 reply.2 4\r\nfail\r\n")
+	ts.s.AssertRead("HPUB reply.2 75 75\r\nNATS/1.0\r\nNats-Service-Error: bad request\r\n" +
+		"Nats-Service-Error-Code: 400\r\n\r\n\r\n")
+
+	// Stats are updated after the handler returns
+	for i := 0; i < 1000 && ts.r.Stats().Endpoints[0].NumRequests < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	ts.s.AssertWrite("MSG $SRV.STATS 7 reply.3 0\r\n\r\n")
+
+	var stats Stats
+	if e := json.Unmarshal(ts.ReadReply("reply.3"), &stats); e != nil {
+		t.Fatal(e)
+	}
+
+	if stats.Type != StatsType || stats.Name != "echo" || stats.Id != ts.r.Id() {
+		t.Errorf("Expected stats of the instance, got %#v", stats)
+	}
+
+	if len(stats.Endpoints) != 1 {
+		t.Fatalf("Expected one endpoint, got %#v", stats.Endpoints)
+	}
+
+	var es = stats.Endpoints[0]
+	if es.NumRequests != 2 || es.NumErrors != 1 || es.LastError != "400:bad request" {
+		t.Errorf("Expected requests and errors to be counted, got %#v", es)
+	}
+
+	ts.Teardown()
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	var ts testService
+
+	ts.Setup(t, Config{Name: "svc", Version: "1.2.3", Description: "A service"})
+
+	ts.s.AssertWrite("MSG $SRV.PING 1 reply.1 0\r\n\r\n")
+
+	var ping Ping
+	if e := json.Unmarshal(ts.ReadReply("reply.1"), &ping); e != nil {
+		t.Fatal(e)
+	}
+
+	var expected = Ping{Type: PingType, Name: "svc", Id: ts.r.Id(), Version: "1.2.3"}
+	if ping != expected {
+		t.Errorf("Expected %#v, got %#v", expected, ping)
+	}
+
+	// Addressed to this instance
+	ts.s.AssertWrite("MSG $SRV.INFO.svc.x 6 reply.2 0\r\n\r\n")
+
+	var info Info
+	if e := json.Unmarshal(ts.ReadReply("reply.2"), &info); e != nil {
+		t.Fatal(e)
+	}
+
+	if info.Type != InfoType || info.Description != "A service" || len(info.Endpoints) != 0 {
+		t.Errorf("Expected info of the instance, got %#v", info)
+	}
+
+	ts.Teardown()
+}
+
+func TestServiceStop(t *testing.T) {
+	var ts testService
+
+	ts.Setup(t, Config{Name: "svc", Version: "1.0.0"})
+
+	ts.Add(1)
+	go func() {
+		ts.r.Stop()
+
+		if e := ts.r.AddEndpoint("a", "a", nil); e != ErrServiceStopped {
+			t.Errorf("Expected ErrServiceStopped, got %#v", e)
+		}
+
+		ts.Done()
+	}()
+
+	for sid := 1; sid <= 9; sid++ {
+		ts.s.AssertRead(fmt.Sprintf("UNSUB %d\r\n", sid))
+	}
+
+	ts.Teardown()
+}
+
+func TestServiceOnFakeClient(t *testing.T) {
+	var f = nats.NewFakeClient()
+	defer f.Close()
+
+	s, e := New(f, Config{Name: "echo", Version: "1.0.0"})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.AddEndpoint("echo", "svc.echo", func(r *Request) {
+		r.Respond(r.Data)
+	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var rc = make(chan string, 1)
+
+	f.Request("svc.echo", []byte("hi"), func(sub *nats.Subscription) {
+		m := <-sub.Inbox
+		sub.Unsubscribe()
+		rc <- string(m.Payload)
+	})
+
+	select {
+	case r := <-rc:
+		if r != "hi" {
+			t.Errorf("Expected hi, got %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a response")
+	}
+
+	if n := f.Interest("svc.echo"); n != 1 {
+		t.Errorf("Expected the endpoint to subscribe once, got %d", n)
+	}
+
+	s.Stop()
+
+	if n := f.Interest("$SRV.PING"); n != 0 {
+		t.Errorf("Expected discovery to unsubscribe on Stop, got %d", n)
+	}
+}
+
+func TestServiceClock(t *testing.T) {
+	var f = nats.NewFakeClient()
+	defer f.Close()
+
+	var clock = test.NewFakeClock()
+	var start = clock.Now()
+
+	s, e := New(f, Config{Name: "svc", Version: "1.0.0", Clock: clock})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.AddEndpoint("slow", "svc.slow", func(r *Request) {
+		clock.Advance(5 * time.Millisecond)
+	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	f.Publish("svc.slow", nil)
+
+	// Stats are updated after the handler returns
+	for i := 0; i < 1000 && s.Stats().Endpoints[0].NumRequests < 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	var stats = s.Stats()
+	if !stats.Started.Equal(start) {
+		t.Errorf("Expected start time %v, got %v", start, stats.Started)
+	}
+
+	if d := stats.Endpoints[0].ProcessingTime; d != 5*time.Millisecond {
+		t.Errorf("Expected processing time of 5ms, got %v", d)
+	}
+
+	s.Stop()
+}
+
+// Stop while discovery requests wait for the lock to be answered
+func TestServiceStopWhileAnswering(t *testing.T) {
+	var f = nats.NewFakeClient()
+	defer f.Close()
+
+	s, e := New(f, Config{Name: "svc", Version: "1.0.0"})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var dc = make(chan bool)
+
+	// Stop waits for the lock first, so it gets it first
+	s.Lock()
+
+	go func() {
+		s.Stop()
+		close(dc)
+	}()
+
+	time.Sleep(time.Millisecond)
+
+	// The first request waits in Stats, the second in delivery
+	f.PublishWithReply("$SRV.STATS", "reply", nil)
+	f.PublishWithReply("$SRV.STATS", "reply", nil)
+	time.Sleep(time.Millisecond)
+
+	s.Unlock()
+
+	select {
+	case <-dc:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to return")
+	}
+}
@@ -10,6 +10,11 @@ type Stopper struct {
 	// Stop channel channel, stop acknowledgement channel
 	scc   chan chan bool
 	sackc chan bool
+
+	// Set when Stop finds nothing running, so a run that is about to start
+	// stops right away instead of running forever
+	lock    sync.Mutex
+	stopped bool
 }
 
 func (s *Stopper) Init() {
@@ -21,8 +26,12 @@ func (s *Stopper) Stop() {
 
 	s.Init()
 
+	s.lock.Lock()
+
 	select {
 	case sc = <-s.scc:
+		s.lock.Unlock()
+
 		// Trigger stop
 		close(sc)
 
@@ -30,7 +39,8 @@ func (s *Stopper) Stop() {
 		<-s.sackc
 
 	default:
-		return
+		s.stopped = true
+		s.lock.Unlock()
 	}
 }
 
@@ -39,13 +49,24 @@ func (s *Stopper) MarkStart() chan bool {
 
 	s.Init()
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	// Create stop acknowledgement channel
-	// This doesn't need a lock because it can only be used after Stop() has
-	// acquired the stop channel, which is not yet available at this point.
+	// Stop() only waits on it after it acquired the stop channel, which is
+	// not yet available at this point.
 	s.sackc = make(chan bool)
 
 	// Create stop channel
 	sc = make(chan bool)
+
+	// Stopped before it started
+	if s.stopped {
+		s.stopped = false
+		close(sc)
+		return sc
+	}
+
 	s.scc <- sc
 
 	return sc
@@ -0,0 +1,33 @@
+package nats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopperStopBeforeStart(t *testing.T) {
+	var s Stopper
+
+	s.Stop()
+
+	select {
+	case <-s.MarkStart():
+	case <-time.After(time.Second):
+		t.Errorf("Expected the stop channel to be closed")
+	}
+
+	s.MarkStop()
+}
+
+func TestStopperStopWhileRunning(t *testing.T) {
+	var s Stopper
+	var sc = s.MarkStart()
+
+	go func() {
+		<-sc
+		s.MarkStop()
+	}()
+
+	// Returns once the run acknowledged
+	s.Stop()
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock that only moves when told to, for testing timeouts, backoff and
+// keepalive without waiting. Satisfies the Clock interface of the client.
+type FakeClock struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// Fake clock starting at a fixed time, so runs are repeatable
+func NewFakeClock() *FakeClock {
+	var f = new(FakeClock)
+
+	f.cond = sync.NewCond(&f.lock)
+	f.now = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	return f
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *FakeClock) Sleep(d time.Duration) {
+	c, _ := f.NewTimer(d)
+	<-c
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	var w = f.add(d, 0)
+
+	return w.c, func() bool { return f.remove(w) }
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		panic("test: non-positive interval for NewTicker")
+	}
+
+	var w = f.add(d, d)
+
+	return w.c, func() { f.remove(w) }
+}
+
+func (f *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var w = &fakeWaiter{at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+
+	// Timers that are already due fire right away
+	if d <= 0 && period == 0 {
+		w.c <- f.now
+		return w
+	}
+
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+
+	return w
+}
+
+// Returns whether w was still waiting
+func (f *FakeClock) remove(w *fakeWaiter) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, v := range f.waiters {
+		if v == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.cond.Broadcast()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Move the clock forward by d, firing timers and tickers that come due in
+// order. Like real tickers, ticks are dropped while the receiver lags.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var end = f.now.Add(d)
+
+	for len(f.waiters) > 0 {
+		sort.SliceStable(f.waiters, func(i, j int) bool {
+			return f.waiters[i].at.Before(f.waiters[j].at)
+		})
+
+		var w = f.waiters[0]
+		if w.at.After(end) {
+			break
+		}
+
+		f.now = w.at
+
+		select {
+		case w.c <- f.now:
+		default:
+		}
+
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+
+	f.now = end
+	f.cond.Broadcast()
+}
+
+// Number of timers, tickers and sleeps waiting
+func (f *FakeClock) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.waiters)
+}
+
+// Block until at least n timers, tickers or sleeps are waiting, so the code
+// under test is known to be waiting before the clock is advanced
+func (f *FakeClock) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
@@ -0,0 +1,278 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Servers on loopback ports that route messages between each other, for
+// failover tests. Nodes can be killed, restarted on the same address, and
+// partitioned from each other. Every node advertises the addresses of all
+// nodes in INFO, so clients can discover them.
+type Cluster struct {
+	// Shared by all nodes
+	lock *sync.Mutex
+
+	nodes []*Server
+	addrs []string
+	down  []bool
+
+	// Partition each node is in; nodes only route to their own partition
+	partition []int
+
+	restarts []int
+}
+
+// Cluster of n nodes, not started yet. Nodes can be configured through Node
+// before Start.
+func NewCluster(n int) *Cluster {
+	var c = new(Cluster)
+
+	c.lock = new(sync.Mutex)
+	c.nodes = make([]*Server, n)
+	c.addrs = make([]string, n)
+	c.down = make([]bool, n)
+	c.partition = make([]int, n)
+	c.restarts = make([]int, n)
+
+	for i := range c.nodes {
+		c.nodes[i] = c.newNode(i, NewServer())
+		c.nodes[i].ServerId = fmt.Sprintf("node-%d", i)
+	}
+
+	return c
+}
+
+// Server with the configuration of s, joined to the cluster as node i
+func (c *Cluster) newNode(i int, s *Server) *Server {
+	var n = NewServer()
+
+	n.Username = s.Username
+	n.Password = s.Password
+	n.AuthToken = s.AuthToken
+	n.TLSRequired = s.TLSRequired
+	n.TLSConfig = s.TLSConfig
+	n.ServerId = s.ServerId
+	n.Version = s.Version
+	n.MaxPayload = s.MaxPayload
+	n.Headers = s.Headers
+	n.ConnectUrls = s.ConnectUrls
+
+	n.lock = c.lock
+	n.cluster = c
+	n.node = i
+
+	return n
+}
+
+// Listen on a loopback port with every node
+func (c *Cluster) Start() error {
+	var ls = make([]net.Listener, len(c.nodes))
+
+	// All addresses are known before the first client connects
+	for i := range c.nodes {
+		l, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			for _, l := range ls[:i] {
+				l.Close()
+			}
+
+			return e
+		}
+
+		ls[i] = l
+		c.addrs[i] = l.Addr().String()
+	}
+
+	for i, n := range c.nodes {
+		n.ConnectUrls = c.Addrs()
+		n.accept(ls[i])
+	}
+
+	return nil
+}
+
+// Node i, to configure before Start or to inspect
+func (c *Cluster) Node(i int) *Server {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.nodes[i]
+}
+
+// Addresses of all nodes, including the ones that are down
+func (c *Cluster) Addrs() []string {
+	return append([]string(nil), c.addrs...)
+}
+
+// Stop node i, closing its listener and client connections
+func (c *Cluster) Kill(i int) {
+	c.lock.Lock()
+	c.down[i] = true
+	var n = c.nodes[i]
+	c.lock.Unlock()
+
+	n.Close()
+}
+
+// Start node i again on the same address, with a new server id
+func (c *Cluster) Restart(i int) error {
+	c.lock.Lock()
+	if !c.down[i] {
+		c.lock.Unlock()
+		c.Kill(i)
+		c.lock.Lock()
+	}
+
+	c.restarts[i]++
+
+	var n = c.newNode(i, c.nodes[i])
+	n.ServerId = fmt.Sprintf("node-%d.%d", i, c.restarts[i])
+
+	c.nodes[i] = n
+	c.lock.Unlock()
+
+	_, e := n.listen(c.addrs[i])
+	if e != nil {
+		return e
+	}
+
+	c.lock.Lock()
+	c.down[i] = false
+	c.lock.Unlock()
+
+	return nil
+}
+
+// Split the cluster: nodes in the same group only route to each other.
+// Nodes in no group form one more partition.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := range c.partition {
+		c.partition[i] = 0
+	}
+
+	for g, nodes := range groups {
+		for _, i := range nodes {
+			c.partition[i] = g + 1
+		}
+	}
+}
+
+// Undo Partition
+func (c *Cluster) Heal() {
+	c.Partition()
+}
+
+// Expects to be called when the lock is held
+func (c *Cluster) reachable(from *Server) []*Server {
+	var r []*Server
+
+	for i, n := range c.nodes {
+		if !c.down[i] && c.partition[i] == c.partition[from.node] {
+			r = append(r, n)
+		}
+	}
+
+	return r
+}
+
+// Expects to be called when the lock is held
+func (s *Server) reachable() []*Server {
+	if s.cluster == nil {
+		return []*Server{s}
+	}
+
+	return s.cluster.reachable(s)
+}
+
+// Nodes that are up
+func (c *Cluster) live() []*Server {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var r []*Server
+	for i, n := range c.nodes {
+		if !c.down[i] {
+			r = append(r, n)
+		}
+	}
+
+	return r
+}
+
+// Subscriptions on nodes that are up that match subject, counting each
+// queue group once even if its members are spread over several nodes
+func (c *Cluster) Interest(subject string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var n int
+	var groups = make(map[queueGroup]bool)
+
+	for i, s := range c.nodes {
+		if !c.down[i] {
+			n += s.interest(subject, groups)
+		}
+	}
+
+	return n
+}
+
+// Clients connected to nodes that are up
+func (c *Cluster) NumClients() int {
+	var n int
+	for _, s := range c.live() {
+		n += s.NumClients()
+	}
+
+	return n
+}
+
+// Fail the test unless cond holds within d
+func WaitFor(t *testing.T, d time.Duration, what string, cond func() bool) bool {
+	var deadline = time.Now().Add(d)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Errorf("Expected %s within %v", what, d)
+			return false
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return true
+}
+
+// Fail the test unless n subscriptions on live nodes match subject within d,
+// such as after clients failed over and resubscribed
+func (c *Cluster) AssertInterest(t *testing.T, subject string, n int, d time.Duration) bool {
+	return WaitFor(t, d, fmt.Sprintf("%d subscriptions on %s", n, subject), func() bool {
+		return c.Interest(subject) == n
+	})
+}
+
+// Fail the test unless n clients are connected to live nodes within d
+func (c *Cluster) AssertClients(t *testing.T, n int, d time.Duration) bool {
+	return WaitFor(t, d, fmt.Sprintf("%d clients", n), func() bool {
+		return c.NumClients() == n
+	})
+}
+
+// Stop all nodes
+func (c *Cluster) Close() {
+	for i := range c.nodes {
+		c.lock.Lock()
+		var n = c.nodes[i]
+		c.down[i] = true
+		c.lock.Unlock()
+
+		n.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidCommand  = errors.New("test: invalid command")
+	ErrPayloadTooLarge = errors.New("test: payload too large")
+)
+
+// Command sent by a client, as parsed by the test server side
+type Command struct {
+	// Upper case name, such as PUB or SUB
+	Op string
+
+	// Line as received, without CRLF
+	Line string
+
+	// Fields, where the command has them
+	Subject string
+	Queue   string
+	ReplyTo string
+	Sid     string
+	Max     int
+
+	// Header block and payload of PUB and HPUB
+	Header  []byte
+	Payload []byte
+
+	// Options of CONNECT
+	Options map[string]interface{}
+}
+
+// Short form for transcripts: the line, and the payload if any
+func (c *Command) String() string {
+	if c.Op == "PUB" || c.Op == "HPUB" {
+		return fmt.Sprintf("%s %q", c.Line, string(c.Header)+string(c.Payload))
+	}
+
+	return c.Line
+}
+
+// Read the next command a client sends. Payloads larger than max are
+// refused if max is positive. Malformed commands return ErrInvalidCommand,
+// along with what could be parsed.
+func ReadCommand(r *bufio.Reader, max int64) (*Command, error) {
+	var line string
+	var f []string
+	var e error
+
+	// Skip empty lines
+	for len(f) == 0 {
+		line, e = r.ReadString('\n')
+		if e != nil {
+			return nil, e
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		f = strings.Fields(line)
+	}
+
+	var c = &Command{Line: line}
+
+	c.Op = strings.ToUpper(f[0])
+
+	var args = f[1:]
+
+	switch c.Op {
+	case "CONNECT":
+		if json.Unmarshal([]byte(strings.TrimSpace(line[len(f[0]):])), &c.Options) != nil {
+			e = ErrInvalidCommand
+		}
+	case "SUB":
+		switch len(args) {
+		case 2:
+			c.Subject, c.Sid = args[0], args[1]
+		case 3:
+			c.Subject, c.Queue, c.Sid = args[0], args[1], args[2]
+		default:
+			e = ErrInvalidCommand
+		}
+	case "UNSUB":
+		switch len(args) {
+		case 1:
+			c.Sid = args[0]
+		case 2:
+			var err error
+
+			c.Sid = args[0]
+			c.Max, err = strconv.Atoi(args[1])
+			if err != nil {
+				e = ErrInvalidCommand
+			}
+		default:
+			e = ErrInvalidCommand
+		}
+	case "PUB", "HPUB":
+		e = c.readPayload(args, r, max)
+	case "PING", "PONG":
+	default:
+		e = ErrInvalidCommand
+	}
+
+	if e != nil {
+		return c, e
+	}
+
+	return c, nil
+}
+
+func (c *Command) readPayload(args []string, r *bufio.Reader, max int64) error {
+	var sizes = 1
+	if c.Op == "HPUB" || c.Op == "HMSG" {
+		sizes = 2
+	}
+
+	if len(args) != 1+sizes && len(args) != 2+sizes {
+		return ErrInvalidCommand
+	}
+
+	c.Subject = args[0]
+	if len(args) == 2+sizes {
+		c.ReplyTo = args[1]
+	}
+
+	var headerSize int
+	var e error
+
+	if c.Op == "HPUB" || c.Op == "HMSG" {
+		headerSize, e = strconv.Atoi(args[len(args)-2])
+		if e != nil {
+			return ErrInvalidCommand
+		}
+	}
+
+	size, e := strconv.Atoi(args[len(args)-1])
+	if e != nil || size < headerSize || headerSize < 0 {
+		return ErrInvalidCommand
+	}
+
+	if max > 0 && int64(size) > max {
+		return ErrPayloadTooLarge
+	}
+
+	var buf = make([]byte, size+2)
+
+	_, e = io.ReadFull(r, buf)
+	if e != nil {
+		return e
+	}
+
+	if string(buf[size:]) != "\r\n" {
+		return ErrInvalidCommand
+	}
+
+	c.Header = buf[:headerSize]
+	c.Payload = buf[headerSize:size]
+
+	return nil
+}
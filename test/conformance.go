@@ -0,0 +1,618 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ErrNoDelivery = errors.New("test: no message delivered")
+
+// Time the conformance suites wait for any single frame or message
+var ConformanceTimeout = 2 * time.Second
+
+// Message a client under test delivered
+type Delivery struct {
+	Subject string
+	Sid     int
+	ReplyTo string
+	Payload []byte
+}
+
+// Client side of the protocol, adapted for RunClientConformance
+type ConformanceClient interface {
+	Subscribe(subject, queue string, sid int) error
+
+	// Unsubscribe after max more messages, or right away if max is zero
+	Unsubscribe(sid int, max int) error
+
+	Publish(subject, reply string, payload []byte) error
+
+	// Send a PING and wait for its PONG
+	Ping() error
+
+	// Next message the client received, ErrNoDelivery if there is none
+	// within d
+	Next(d time.Duration) (*Delivery, error)
+
+	Close() error
+}
+
+// Run the client side conformance suite. The suite plays the server on the
+// other end of a pipe; connect wraps the client end in the client under
+// test, which should consider itself connected without a handshake.
+func RunClientConformance(t *testing.T, connect func(n net.Conn) ConformanceClient) {
+	var cases = []struct {
+		name string
+		f    func(t *testing.T, c ConformanceClient, sc *Script)
+	}{
+		{"PublishEmptyPayload", clientPublishEmptyPayload},
+		{"PublishPayloadWithCRLF", clientPublishPayloadWithCRLF},
+		{"PublishWithReply", clientPublishWithReply},
+		{"Subscribe", clientSubscribe},
+		{"AutoUnsubscribe", clientAutoUnsubscribe},
+		{"DeliverEmptyPayload", clientDeliverEmptyPayload},
+		{"DeliverPayloadWithCRLF", clientDeliverPayloadWithCRLF},
+		{"DeliverMaximumPayload", clientDeliverMaximumPayload},
+		{"DeliverFragmented", clientDeliverFragmented},
+		{"DeliverCoalesced", clientDeliverCoalesced},
+		{"AnswerPing", clientAnswerPing},
+		{"PongAfterMessages", clientPongAfterMessages},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nc, ns := net.Pipe()
+
+			c := connect(nc)
+			sc := NewScript(t, ns)
+			sc.Timeout = ConformanceTimeout
+
+			tc.f(t, c, sc)
+
+			c.Close()
+			ns.Close()
+		})
+	}
+}
+
+// Run f in the background, failing the test if it returns an error
+func background(t *testing.T, what string, f func() error) chan bool {
+	var dc = make(chan bool)
+
+	go func() {
+		defer close(dc)
+
+		if e := f(); e != nil {
+			t.Errorf("%s: %v", what, e)
+		}
+	}()
+
+	return dc
+}
+
+func wait(t *testing.T, dc chan bool) {
+	select {
+	case <-dc:
+	case <-time.After(ConformanceTimeout):
+		t.Errorf("Expected call to return within %v", ConformanceTimeout)
+	}
+}
+
+func next(t *testing.T, c ConformanceClient, subject string, sid int, reply string, payload []byte) {
+	d, e := c.Next(ConformanceTimeout)
+	if e != nil {
+		t.Errorf("Expected delivery on %s: %v", subject, e)
+		return
+	}
+
+	if d.Subject != subject || d.Sid != sid || d.ReplyTo != reply || !bytes.Equal(d.Payload, payload) {
+		t.Errorf("Expected %s %d %q %q, got %s %d %q %q",
+			subject, sid, reply, payload, d.Subject, d.Sid, d.ReplyTo, d.Payload)
+	}
+}
+
+func clientPublishEmptyPayload(t *testing.T, c ConformanceClient, sc *Script) {
+	dc := background(t, "Publish", func() error { return c.Publish("foo", "", nil) })
+	sc.Expect("PUB", Subject("foo"), ReplyTo(""), Payload(""))
+	wait(t, dc)
+}
+
+func clientPublishPayloadWithCRLF(t *testing.T, c ConformanceClient, sc *Script) {
+	var p = "\r\nPUB foo 2\r\nhi\r\n"
+
+	dc := background(t, "Publish", func() error { return c.Publish("foo", "", []byte(p)) })
+	sc.Expect("PUB", Subject("foo"), Payload(p))
+	wait(t, dc)
+}
+
+func clientPublishWithReply(t *testing.T, c ConformanceClient, sc *Script) {
+	dc := background(t, "Publish", func() error { return c.Publish("foo", "bar", []byte("hi")) })
+	sc.Expect("PUB", Subject("foo"), ReplyTo("bar"), Payload("hi"))
+	wait(t, dc)
+}
+
+func clientSubscribe(t *testing.T, c ConformanceClient, sc *Script) {
+	dc := background(t, "Subscribe", func() error {
+		if e := c.Subscribe("foo.*", "", 1); e != nil {
+			return e
+		}
+
+		return c.Subscribe("bar.>", "workers", 2)
+	})
+
+	sc.Expect("SUB", Subject("foo.*"), Queue(""), Sid("1"))
+	sc.Expect("SUB", Subject("bar.>"), Queue("workers"), Sid("2"))
+	wait(t, dc)
+}
+
+func clientAutoUnsubscribe(t *testing.T, c ConformanceClient, sc *Script) {
+	dc := background(t, "Unsubscribe", func() error {
+		if e := c.Unsubscribe(1, 2); e != nil {
+			return e
+		}
+
+		return c.Unsubscribe(2, 0)
+	})
+
+	if u := sc.Expect("UNSUB", Sid("1"), Max(2)); u != nil && u.Line != "UNSUB 1 2" {
+		t.Errorf("Expected UNSUB 1 2, got %s", u.Line)
+	}
+
+	if u := sc.Expect("UNSUB", Sid("2")); u != nil && u.Line != "UNSUB 2" {
+		t.Errorf("Expected UNSUB 2 without a maximum, got %s", u.Line)
+	}
+
+	wait(t, dc)
+}
+
+func clientDeliverEmptyPayload(t *testing.T, c ConformanceClient, sc *Script) {
+	sc.Send("MSG foo 1 0\r\n\r\n")
+	next(t, c, "foo", 1, "", []byte{})
+}
+
+func clientDeliverPayloadWithCRLF(t *testing.T, c ConformanceClient, sc *Script) {
+	var p = "\r\nMSG foo 1 2\r\nhi\r\n"
+
+	sc.Send(Msg("foo", "1", "bar", p))
+	next(t, c, "foo", 1, "bar", []byte(p))
+}
+
+func clientDeliverMaximumPayload(t *testing.T, c ConformanceClient, sc *Script) {
+	var p = bytes.Repeat([]byte("x"), DefaultMaxPayload)
+
+	go sc.Send(Msg("foo", "1", "", string(p)))
+	next(t, c, "foo", 1, "", p)
+}
+
+func clientDeliverFragmented(t *testing.T, c ConformanceClient, sc *Script) {
+	var frame = Msg("foo", "1", "", "fragmented")
+
+	go func() {
+		for i := 0; i < len(frame); i++ {
+			sc.n.Write([]byte{frame[i]})
+		}
+	}()
+
+	next(t, c, "foo", 1, "", []byte("fragmented"))
+}
+
+func clientDeliverCoalesced(t *testing.T, c ConformanceClient, sc *Script) {
+	go sc.Send(Msg("foo", "1", "", "a"), Msg("foo", "1", "", ""), Msg("bar", "2", "r", "c"))
+
+	next(t, c, "foo", 1, "", []byte("a"))
+	next(t, c, "foo", 1, "", []byte{})
+	next(t, c, "bar", 2, "r", []byte("c"))
+}
+
+func clientAnswerPing(t *testing.T, c ConformanceClient, sc *Script) {
+	for i := 0; i < 3; i++ {
+		sc.Send(FramePing)
+		sc.Expect("PONG")
+	}
+}
+
+// Ping returns after a PONG that follows messages, which are delivered in
+// order with the ones after it
+func clientPongAfterMessages(t *testing.T, c ConformanceClient, sc *Script) {
+	dc := background(t, "Ping", c.Ping)
+
+	sc.Expect("PING")
+	sc.Send(Msg("foo", "1", "", "1"), Msg("foo", "1", "", "2"), FramePong)
+	wait(t, dc)
+
+	go sc.Send(Msg("foo", "1", "", "3"))
+
+	for _, p := range []string{"1", "2", "3"} {
+		d, e := c.Next(ConformanceTimeout)
+		if e != nil || string(d.Payload) != p {
+			t.Errorf("Expected message %s, got %#v, %v", p, d, e)
+		}
+	}
+}
+
+// Raw client connection used by RunServerConformance
+type rawClient struct {
+	t    *testing.T
+	n    net.Conn
+	r    *bufio.Reader
+	info map[string]interface{}
+}
+
+// Run the server side conformance suite against the server dial connects
+// to. The suite speaks the protocol directly, without a client
+// implementation, and requires that the server needs no credentials or TLS.
+func RunServerConformance(t *testing.T, dial func() (net.Conn, error)) {
+	var cases = []struct {
+		name string
+		f    func(t *testing.T, connect func(verbose bool) *rawClient)
+	}{
+		{"InfoFirst", serverInfoFirst},
+		{"VerboseAcknowledgements", serverVerboseAcknowledgements},
+		{"NoAcknowledgements", serverNoAcknowledgements},
+		{"EmptyPayload", serverEmptyPayload},
+		{"PayloadWithCRLF", serverPayloadWithCRLF},
+		{"MaximumPayload", serverMaximumPayload},
+		{"PayloadTooLarge", serverPayloadTooLarge},
+		{"AutoUnsubscribe", serverAutoUnsubscribe},
+		{"AutoUnsubscribeAlreadyReached", serverAutoUnsubscribeAlreadyReached},
+		{"QueueGroupDistribution", serverQueueGroupDistribution},
+		{"PongAfterMessages", serverPongAfterMessages},
+		{"PongPerPing", serverPongPerPing},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var clients []*rawClient
+
+			connect := func(verbose bool) *rawClient {
+				n, e := dial()
+				if e != nil {
+					t.Fatal(e)
+				}
+
+				var c = &rawClient{t: t, n: n, r: bufio.NewReader(n)}
+				clients = append(clients, c)
+
+				c.connect(verbose)
+
+				return c
+			}
+
+			tc.f(t, connect)
+
+			for _, c := range clients {
+				c.n.Close()
+			}
+		})
+	}
+}
+
+func (c *rawClient) send(s string) {
+	c.n.SetWriteDeadline(time.Now().Add(ConformanceTimeout))
+
+	if _, e := io.WriteString(c.n, s); e != nil {
+		c.t.Fatalf("Error: %#v", e)
+	}
+}
+
+func (c *rawClient) read() *Command {
+	c.n.SetReadDeadline(time.Now().Add(ConformanceTimeout))
+
+	f, e := ReadFrame(c.r)
+	if e != nil {
+		c.t.Fatalf("Error: %#v", e)
+	}
+
+	return f
+}
+
+func (c *rawClient) expect(op string) *Command {
+	f := c.read()
+	if f.Op != op {
+		c.t.Fatalf("Expected %s, got %s", op, f.Line)
+	}
+
+	return f
+}
+
+// Only a verbose session acknowledges CONNECT, and every other command
+func (c *rawClient) connect(verbose bool) {
+	c.info = c.expect("INFO").Options
+	c.send(fmt.Sprintf("CONNECT {\"verbose\":%t,\"pedantic\":false,\"headers\":true}\r\n", verbose))
+
+	if verbose {
+		c.expect("+OK")
+	}
+}
+
+// Round trip, returning the messages received before the PONG
+func (c *rawClient) flush() []*Command {
+	var msgs []*Command
+
+	c.send("PING\r\n")
+
+	for {
+		f := c.read()
+
+		switch f.Op {
+		case "PONG":
+			return msgs
+		case "MSG", "HMSG":
+			msgs = append(msgs, f)
+		default:
+			c.t.Fatalf("Expected MSG or PONG, got %s", f.Line)
+		}
+	}
+}
+
+func (c *rawClient) maxPayload() int {
+	v, ok := c.info["max_payload"].(float64)
+	if !ok || v <= 0 {
+		c.t.Fatalf("Expected max_payload in INFO, got %#v", c.info)
+	}
+
+	return int(v)
+}
+
+func expectMessages(t *testing.T, msgs []*Command, payloads ...string) {
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Payload))
+	}
+
+	if strings.Join(got, "|") != strings.Join(payloads, "|") || len(got) != len(payloads) {
+		t.Errorf("Expected messages %q, got %q", payloads, got)
+	}
+}
+
+func serverInfoFirst(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	for _, k := range []string{"server_id", "max_payload"} {
+		if _, ok := c.info[k]; !ok {
+			t.Errorf("Expected %s in INFO, got %#v", k, c.info)
+		}
+	}
+
+	c.flush()
+}
+
+func serverVerboseAcknowledgements(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(true)
+
+	c.send("SUB foo 1\r\n")
+	c.expect("+OK")
+
+	c.send("UNSUB 1\r\n")
+	c.expect("+OK")
+
+	// PING is answered by its PONG alone
+	c.send("PING\r\n")
+	c.expect("PONG")
+}
+
+func serverNoAcknowledgements(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	// The PONG is the first frame after INFO
+	c.send("SUB foo 1\r\nUNSUB 1\r\nPUB bar 0\r\n\r\nPING\r\n")
+	c.expect("PONG")
+}
+
+func serverEmptyPayload(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	c.send("SUB foo 1\r\nPUB foo 0\r\n\r\n")
+	msgs := c.flush()
+
+	expectMessages(t, msgs, "")
+	if len(msgs) == 1 && msgs[0].Line != "MSG foo 1 0" {
+		t.Errorf("Expected MSG foo 1 0, got %s", msgs[0].Line)
+	}
+}
+
+func serverPayloadWithCRLF(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	var p = "\r\nMSG foo 1 2\r\nhi\r\n"
+
+	c.send(fmt.Sprintf("SUB foo 1\r\nPUB foo bar %d\r\n%s\r\n", len(p), p))
+	msgs := c.flush()
+
+	expectMessages(t, msgs, p)
+	if len(msgs) == 1 && msgs[0].ReplyTo != "bar" {
+		t.Errorf("Expected reply bar, got %q", msgs[0].ReplyTo)
+	}
+}
+
+func serverMaximumPayload(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	var p = strings.Repeat("x", c.maxPayload())
+
+	c.send("SUB foo 1\r\n")
+	c.flush()
+
+	// Over a pipe the write only completes while the MSG is read; the test
+	// goroutine reports the error, since only it may fail the test
+	var ec = make(chan error, 1)
+	go func() {
+		_, e := c.n.Write([]byte(fmt.Sprintf("PUB foo %d\r\n%s\r\n", len(p), p)))
+		ec <- e
+	}()
+
+	m := c.expect("MSG")
+	if len(m.Payload) != len(p) {
+		t.Errorf("Expected %d bytes, got %d", len(p), len(m.Payload))
+	}
+
+	if e := <-ec; e != nil {
+		t.Fatalf("Error: %#v", e)
+	}
+
+	c.flush()
+}
+
+func serverPayloadTooLarge(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	var size = c.maxPayload() + 1
+
+	// The server may refuse before reading the payload
+	go func() {
+		c.n.Write([]byte(fmt.Sprintf("PUB foo %d\r\n%s\r\n", size, strings.Repeat("x", size))))
+	}()
+
+	if f := c.read(); f.Op != "-ERR" {
+		t.Errorf("Expected -ERR, got %s", f.Line)
+	}
+}
+
+func serverAutoUnsubscribe(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	c.send("SUB foo 1\r\nUNSUB 1 2\r\n")
+	c.send("PUB foo 1\r\n1\r\nPUB foo 1\r\n2\r\nPUB foo 1\r\n3\r\n")
+
+	expectMessages(t, c.flush(), "1", "2")
+}
+
+func serverAutoUnsubscribeAlreadyReached(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	c.send("SUB foo 1\r\nPUB foo 1\r\n1\r\n")
+	expectMessages(t, c.flush(), "1")
+
+	// One message was delivered already, so the subscription ends now
+	c.send("UNSUB 1 1\r\nPUB foo 1\r\n2\r\n")
+	expectMessages(t, c.flush())
+}
+
+func serverQueueGroupDistribution(t *testing.T, connect func(verbose bool) *rawClient) {
+	var members = []*rawClient{connect(false), connect(false), connect(false)}
+	var plain = connect(false)
+	var pub = connect(false)
+
+	for _, m := range members {
+		m.send("SUB work workers 1\r\n")
+		m.flush()
+	}
+
+	plain.send("SUB work 1\r\n")
+	plain.flush()
+
+	var n = 30
+	for i := 0; i < n; i++ {
+		pub.send(fmt.Sprintf("PUB work %d\r\n%d\r\n", len(strconv.Itoa(i)), i))
+	}
+
+	pub.flush()
+
+	// Every message goes to one member of the group
+	var seen = make(map[string]int)
+	for i, m := range members {
+		msgs := m.flush()
+		if len(msgs) == 0 {
+			t.Errorf("Expected member %d to receive messages", i)
+		}
+
+		for _, msg := range msgs {
+			seen[string(msg.Payload)]++
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if c := seen[strconv.Itoa(i)]; c != 1 {
+			t.Errorf("Expected message %d once in the group, got %d", i, c)
+		}
+	}
+
+	// And to every subscriber outside it
+	if msgs := plain.flush(); len(msgs) != n {
+		t.Errorf("Expected %d messages outside the group, got %d", n, len(msgs))
+	}
+}
+
+func serverPongAfterMessages(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	c.send("SUB foo 1\r\n")
+	c.send("PUB foo 1\r\n1\r\nPUB foo 1\r\n2\r\nPUB foo 1\r\n3\r\n")
+
+	expectMessages(t, c.flush(), "1", "2", "3")
+}
+
+func serverPongPerPing(t *testing.T, connect func(verbose bool) *rawClient) {
+	c := connect(false)
+
+	c.send("PING\r\nPING\r\nPING\r\n")
+
+	for i := 0; i < 3; i++ {
+		c.expect("PONG")
+	}
+
+	// Nothing else is pending
+	if msgs := c.flush(); len(msgs) != 0 {
+		t.Errorf("Expected no messages, got %d", len(msgs))
+	}
+}
+
+// Read the next frame a server sends. MSG and HMSG fill in the subject, sid,
+// reply, header and payload, INFO the options, and -ERR keeps its message in
+// the line.
+func ReadFrame(r *bufio.Reader) (*Command, error) {
+	var line string
+	var f []string
+	var e error
+
+	for len(f) == 0 {
+		line, e = r.ReadString('\n')
+		if e != nil {
+			return nil, e
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		f = strings.Fields(line)
+	}
+
+	var c = &Command{Line: line, Op: strings.ToUpper(f[0])}
+	var args = f[1:]
+
+	switch c.Op {
+	case "INFO":
+		if json.Unmarshal([]byte(strings.TrimSpace(line[len(f[0]):])), &c.Options) != nil {
+			return c, ErrInvalidCommand
+		}
+	case "MSG", "HMSG":
+		var sizes = 1
+		if c.Op == "HMSG" {
+			sizes = 2
+		}
+
+		if len(args) != 2+sizes && len(args) != 3+sizes {
+			return c, ErrInvalidCommand
+		}
+
+		c.Subject, c.Sid = args[0], args[1]
+		if len(args) == 3+sizes {
+			c.ReplyTo = args[2]
+		}
+
+		// The payload follows like in PUB and HPUB
+		return c, c.readPayload(append([]string{c.Subject}, args[len(args)-sizes:]...), r, 0)
+	case "PING", "PONG", "+OK", "-ERR":
+	default:
+		return c, ErrInvalidCommand
+	}
+
+	return c, nil
+}
@@ -0,0 +1,351 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrInjectedFault = errors.New("test: injected fault")
+
+// Connection that misbehaves on request. Faults can be changed while the
+// connection is in use; zero values disable them.
+type FaultConn struct {
+	net.Conn
+
+	lock sync.Mutex
+
+	latency   time.Duration
+	bandwidth int
+	readChunk int
+	maxWrite  int
+
+	// Errors returned once the byte counts reach the limits, if set
+	readErr, writeErr     error
+	readLimit, writeLimit int64
+
+	read, written int64
+
+	// Drop everything in both directions without closing
+	blackhole bool
+	deadline  time.Time
+	changed   chan bool
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func NewFaultConn(n net.Conn) *FaultConn {
+	var f = new(FaultConn)
+
+	f.Conn = n
+	f.changed = make(chan bool)
+	f.closed = make(chan bool)
+
+	return f
+}
+
+// Delay every read and write by d
+func (f *FaultConn) SetLatency(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.latency = d
+}
+
+// Limit reads and writes to about n bytes per second each
+func (f *FaultConn) SetBandwidth(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.bandwidth = n
+}
+
+// Return at most n bytes per read, so the reader sees fragmented input
+func (f *FaultConn) SetReadChunk(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.readChunk = n
+}
+
+// Write at most n bytes per write, and fail with io.ErrShortWrite when a
+// write is cut short
+func (f *FaultConn) SetShortWrites(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.maxWrite = n
+}
+
+// Fail reads with e once n bytes in total were read. Uses ErrInjectedFault
+// if e is nil.
+func (f *FaultConn) FailReadAfter(n int64, e error) {
+	if e == nil {
+		e = ErrInjectedFault
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.readLimit = n
+	f.readErr = e
+}
+
+// Fail writes with e once n bytes in total were written. Uses
+// ErrInjectedFault if e is nil.
+func (f *FaultConn) FailWriteAfter(n int64, e error) {
+	if e == nil {
+		e = ErrInjectedFault
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.writeLimit = n
+	f.writeErr = e
+}
+
+// Turn the connection half-open: writes succeed but go nowhere, and reads
+// block until the connection is closed or the read deadline passes
+func (f *FaultConn) Blackhole() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.blackhole = true
+	f.notify()
+}
+
+// Number of bytes passed through in either direction
+func (f *FaultConn) BytesRead() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.read
+}
+
+func (f *FaultConn) BytesWritten() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.written
+}
+
+// Wake blocked reads, expects to be called when the lock is held
+func (f *FaultConn) notify() {
+	close(f.changed)
+	f.changed = make(chan bool)
+}
+
+// Sleep for the latency, and for n bytes at the bandwidth
+func (f *FaultConn) delay(n int) {
+	f.lock.Lock()
+	var d = f.latency
+	if f.bandwidth > 0 {
+		d += time.Duration(n) * time.Second / time.Duration(f.bandwidth)
+	}
+	f.lock.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (f *FaultConn) Read(b []byte) (int, error) {
+	f.lock.Lock()
+
+	if f.readChunk > 0 && len(b) > f.readChunk {
+		b = b[:f.readChunk]
+	}
+
+	if f.readErr != nil {
+		if f.read >= f.readLimit {
+			f.lock.Unlock()
+			return 0, f.readErr
+		}
+
+		if rest := f.readLimit - f.read; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+	}
+
+	var blackhole = f.blackhole
+
+	f.lock.Unlock()
+
+	if blackhole {
+		return 0, f.block()
+	}
+
+	n, e := f.Conn.Read(b)
+
+	f.lock.Lock()
+	blackhole = f.blackhole
+	if !blackhole {
+		f.read += int64(n)
+	}
+	f.lock.Unlock()
+
+	// Data that arrived after the connection went dark is lost
+	if blackhole && e == nil {
+		return 0, f.block()
+	}
+
+	f.delay(n)
+
+	return n, e
+}
+
+// Wait for close or the read deadline
+func (f *FaultConn) block() error {
+	for {
+		f.lock.Lock()
+		var deadline = f.deadline
+		var changed = f.changed
+		f.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case <-f.closed:
+			return net.ErrClosed
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-changed:
+			// Deadline was changed, wait again
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (f *FaultConn) Write(b []byte) (int, error) {
+	f.lock.Lock()
+
+	var p = b
+	var err error
+
+	if f.writeErr != nil {
+		if rest := f.writeLimit - f.written; int64(len(p)) > rest {
+			p = p[:rest]
+			err = f.writeErr
+		}
+	}
+
+	if f.maxWrite > 0 && len(p) > f.maxWrite {
+		p = p[:f.maxWrite]
+		err = io.ErrShortWrite
+	}
+
+	var blackhole = f.blackhole
+
+	f.lock.Unlock()
+
+	f.delay(len(p))
+
+	if blackhole {
+		return len(b), nil
+	}
+
+	var n int
+	if len(p) > 0 {
+		var e error
+
+		n, e = f.Conn.Write(p)
+		if e != nil {
+			err = e
+		}
+	}
+
+	f.lock.Lock()
+	f.written += int64(n)
+	f.lock.Unlock()
+
+	return n, err
+}
+
+func (f *FaultConn) SetDeadline(t time.Time) error {
+	f.setReadDeadline(t)
+	return f.Conn.SetDeadline(t)
+}
+
+func (f *FaultConn) SetReadDeadline(t time.Time) error {
+	f.setReadDeadline(t)
+	return f.Conn.SetReadDeadline(t)
+}
+
+func (f *FaultConn) setReadDeadline(t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.deadline = t
+	f.notify()
+}
+
+func (f *FaultConn) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+	})
+
+	return f.Conn.Close()
+}
+
+// Host the wrapped connection was dialed with, if it knows, so the client
+// can still verify TLS against it
+func (f *FaultConn) DialedHost() string {
+	if dh, ok := f.Conn.(interface{ DialedHost() string }); ok {
+		return dh.DialedHost()
+	}
+
+	return ""
+}
+
+// Dialer wrapping the connections of another dialer in FaultConns
+type FaultDialer struct {
+	Upstream interface {
+		Dial() (net.Conn, error)
+	}
+
+	// Called with every new connection, numbered from zero, before the
+	// client uses it
+	Configure func(i int, f *FaultConn)
+
+	lock  sync.Mutex
+	conns []*FaultConn
+}
+
+func (d *FaultDialer) Dial() (net.Conn, error) {
+	n, e := d.Upstream.Dial()
+	if e != nil {
+		return nil, e
+	}
+
+	var f = NewFaultConn(n)
+
+	d.lock.Lock()
+	var i = len(d.conns)
+	d.conns = append(d.conns, f)
+	d.lock.Unlock()
+
+	if d.Configure != nil {
+		d.Configure(i, f)
+	}
+
+	return f, nil
+}
+
+// Connections dialed so far
+func (d *FaultDialer) Conns() []*FaultConn {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]*FaultConn(nil), d.conns...)
+}
@@ -0,0 +1,245 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Environment variable that makes Verify rewrite golden transcripts instead
+// of comparing against them:
+//
+//	GONATS_UPDATE_GOLDEN=1 go test -run TestName
+//
+// An environment variable rather than a flag, so packages importing this one
+// are free to define their own flags.
+const UpdateGoldenEnv = "GONATS_UPDATE_GOLDEN"
+
+// Secrets in CONNECT, which must not end up in checked in transcripts
+var secretRegexp = regexp.MustCompile(`"(pass|password|auth_token|token)":"(?:[^"\\]|\\.)+"`)
+
+// Bidirectional byte stream of a client session, recorded line by line from
+// the client's point of view. Lines the client wrote start with "C ", lines
+// it read with "S ".
+type Transcript struct {
+	lock sync.Mutex
+
+	lines []string
+
+	// Incomplete lines per direction, flushed when their CRLF arrives
+	partial map[string][]byte
+
+	replacements []replacement
+	conns        int
+}
+
+type replacement struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+func NewTranscript() *Transcript {
+	var tr = new(Transcript)
+
+	tr.partial = make(map[string][]byte)
+
+	return tr
+}
+
+// Rewrite parts that vary between runs, such as inbox names, before lines
+// are recorded
+func (tr *Transcript) Replace(expr, repl string) *Transcript {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	tr.replacements = append(tr.replacements, replacement{regexp.MustCompile(expr), repl})
+
+	return tr
+}
+
+func (tr *Transcript) record(dir string, b []byte) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	var buf = append(tr.partial[dir], b...)
+
+	for {
+		var i = bytes.Index(buf, []byte("\r\n"))
+		if i < 0 {
+			break
+		}
+
+		var line = string(buf[:i])
+		if strings.HasPrefix(line, "CONNECT ") {
+			line = secretRegexp.ReplaceAllString(line, `"$1":"[REDACTED]"`)
+		}
+
+		for _, r := range tr.replacements {
+			line = r.re.ReplaceAllString(line, r.repl)
+		}
+
+		tr.lines = append(tr.lines, dir+" "+line)
+		buf = buf[i+2:]
+	}
+
+	tr.partial[dir] = append([]byte(nil), buf...)
+}
+
+// Record everything passing through n
+func (tr *Transcript) Wrap(n net.Conn) net.Conn {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	// Bytes left over from a previous connection will never be completed
+	tr.partial = make(map[string][]byte)
+
+	tr.conns++
+	tr.lines = append(tr.lines, fmt.Sprintf("-- connection %d", tr.conns))
+
+	return &recordingConn{n, tr}
+}
+
+// Number of connections recorded so far
+func (tr *Transcript) Connections() int {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	return tr.conns
+}
+
+func (tr *Transcript) String() string {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	return strings.Join(tr.lines, "\n") + "\n"
+}
+
+// Compare the transcript with the golden file at path, or write it there
+// when UpdateGoldenEnv is set
+func (tr *Transcript) Verify(t *testing.T, path string) bool {
+	var got = tr.String()
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		e := os.MkdirAll(filepath.Dir(path), 0755)
+		if e == nil {
+			e = os.WriteFile(path, []byte(got), 0644)
+		}
+
+		if e != nil {
+			t.Errorf("Error: %#v", e)
+			return false
+		}
+
+		return true
+	}
+
+	b, e := os.ReadFile(path)
+	if e != nil {
+		t.Errorf("Error: %#v (set %s to create it)", e, UpdateGoldenEnv)
+		return false
+	}
+
+	var want = string(b)
+	if want == got {
+		return true
+	}
+
+	t.Errorf("Transcript differs from %s (- golden, + got; set %s to accept):\n%s",
+		path, UpdateGoldenEnv, diffLines(strings.Split(want, "\n"), strings.Split(got, "\n")))
+
+	return false
+}
+
+// Line diff based on the longest common subsequence
+func diffLines(a, b []string) string {
+	var l = make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else if l[i+1][j] >= l[i][j+1] {
+				l[i][j] = l[i+1][j]
+			} else {
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	var i, j int
+
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&buf, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || l[i+1][j] >= l[i][j+1]):
+			fmt.Fprintf(&buf, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&buf, "+ %s\n", b[j])
+			j++
+		}
+	}
+
+	return buf.String()
+}
+
+type recordingConn struct {
+	net.Conn
+	tr *Transcript
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, e := c.Conn.Read(b)
+	c.tr.record("S", b[:n])
+
+	return n, e
+}
+
+// Recorded before it is written, since over a pipe the reply may be read
+// before Write returns
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.tr.record("C", b)
+
+	return c.Conn.Write(b)
+}
+
+// Host the wrapped connection was dialed with, if it knows, so the client
+// can still verify TLS against it
+func (c *recordingConn) DialedHost() string {
+	if dh, ok := c.Conn.(interface{ DialedHost() string }); ok {
+		return dh.DialedHost()
+	}
+
+	return ""
+}
+
+// Dialer recording every connection of another dialer into a transcript
+type RecordingDialer struct {
+	Upstream interface {
+		Dial() (net.Conn, error)
+	}
+
+	*Transcript
+}
+
+func (d RecordingDialer) Dial() (net.Conn, error) {
+	n, e := d.Upstream.Dial()
+	if e != nil {
+		return nil, e
+	}
+
+	return d.Wrap(n), nil
+}
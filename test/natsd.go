@@ -0,0 +1,589 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/gonats/internal/match"
+)
+
+// Maximum payload a Server accepts if none is configured
+const DefaultMaxPayload = 1024 * 1024
+
+// Server speaking the NATS protocol in process, for tests that need real
+// pub/sub between clients. It has its own parser for the client side of the
+// protocol, since this package can't import the client package.
+//
+// Clients connect through a loopback listener (Listen) or through net.Pipe
+// (Pipe). Configure the server before the first client connects.
+type Server struct {
+	// Credentials clients must send in CONNECT, if set
+	Username  string
+	Password  string
+	AuthToken string
+
+	// Require clients to upgrade to TLS after INFO. Uses the certificate of
+	// StartTLS if TLSConfig is nil.
+	TLSRequired bool
+	TLSConfig   *tls.Config
+
+	// Sent in INFO
+	ServerId    string
+	Version     string
+	MaxPayload  int64
+	Headers     bool
+	ConnectUrls []string
+
+	// Shared by the nodes of a cluster, so routing sees all of them at once
+	lock *sync.Mutex
+
+	l        net.Listener
+	conns    map[*serverConn]bool
+	closed   bool
+	wg       sync.WaitGroup
+	rotation int
+
+	// Cluster the server is a node of, if any
+	cluster *Cluster
+	node    int
+}
+
+func NewServer() *Server {
+	var s = new(Server)
+
+	s.ServerId = "test"
+	s.Version = "0.0.0"
+	s.MaxPayload = DefaultMaxPayload
+	s.Headers = true
+	s.lock = new(sync.Mutex)
+	s.conns = make(map[*serverConn]bool)
+
+	return s
+}
+
+// Accept clients on a loopback port, returns host:port to dial
+func (s *Server) Listen() (string, error) {
+	return s.listen("127.0.0.1:0")
+}
+
+func (s *Server) listen(addr string) (string, error) {
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return "", e
+	}
+
+	s.accept(l)
+
+	return l.Addr().String(), nil
+}
+
+// Serve clients connecting to l
+func (s *Server) accept(l net.Listener) {
+	s.lock.Lock()
+	s.l = l
+	s.lock.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			n, e := l.Accept()
+			if e != nil {
+				return
+			}
+
+			s.serve(n)
+		}
+	}()
+}
+
+// Client side of a new in-memory connection to the server
+func (s *Server) Pipe() net.Conn {
+	nc, ns := net.Pipe()
+
+	s.serve(ns)
+
+	return nc
+}
+
+// Close the listener and all client connections, and wait for them
+func (s *Server) Close() {
+	s.lock.Lock()
+
+	s.closed = true
+
+	if s.l != nil {
+		s.l.Close()
+	}
+
+	for c := range s.conns {
+		c.n.Close()
+	}
+
+	s.lock.Unlock()
+
+	s.wg.Wait()
+}
+
+// Close all client connections, leaving the listener open, so clients
+// reconnect
+func (s *Server) CloseConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.conns {
+		c.n.Close()
+	}
+}
+
+// Number of clients that are connected and passed authentication
+func (s *Server) NumClients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for c := range s.conns {
+		if c.connected {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *Server) serve(n net.Conn) {
+	var c = newServerConn(s, n)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		n.Close()
+		return
+	}
+
+	s.conns[c] = true
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		c.flush()
+
+		// Pending frames, such as a final -ERR, were written
+		c.n.Close()
+	}()
+
+	go func() {
+		defer s.wg.Done()
+		c.run()
+
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+	}()
+}
+
+// Number of subscriptions a message on subject would be delivered to,
+// counting each queue group once
+func (s *Server) Interest(subject string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.interest(subject, make(map[queueGroup]bool))
+}
+
+// Like Interest, skipping queue groups already in groups and adding the
+// ones it counts. Expects to be called when the lock is held.
+func (s *Server) interest(subject string, groups map[queueGroup]bool) int {
+	var n int
+
+	for c := range s.conns {
+		for _, sub := range c.subs {
+			if !match.Subject(sub.subject, subject) {
+				continue
+			}
+
+			if sub.queue == "" {
+				n++
+			} else if !groups[sub.group()] {
+				groups[sub.group()] = true
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+func (s *Server) authRequired() bool {
+	return s.Username != "" || s.AuthToken != ""
+}
+
+type serverSub struct {
+	c       *serverConn
+	subject string
+	queue   string
+	sid     string
+
+	// Messages left until the subscription is removed, zero for unlimited
+	max      int
+	received int
+}
+
+// Queue groups are per subject, like on a real server: subscribers to
+// different subjects in the same queue each get their own copy
+type queueGroup struct {
+	subject string
+	queue   string
+}
+
+func (sub *serverSub) group() queueGroup {
+	return queueGroup{sub.subject, sub.queue}
+}
+
+// Deliver a message to the matching subscriptions, one per queue group,
+// on this server and the cluster nodes it can reach. Expects to be called
+// when the lock is held.
+func (s *Server) route(from *serverConn, subject, reply string, header, payload []byte) {
+	var groups = make(map[queueGroup][]*serverSub)
+	var targets []*serverSub
+	var conns []*serverConn
+
+	for _, n := range s.reachable() {
+		for c := range n.conns {
+			conns = append(conns, c)
+		}
+	}
+
+	for _, c := range conns {
+		if c == from && !c.echo {
+			continue
+		}
+
+		for _, sub := range c.subs {
+			if !match.Subject(sub.subject, subject) {
+				continue
+			}
+
+			if sub.queue == "" {
+				targets = append(targets, sub)
+			} else {
+				groups[sub.group()] = append(groups[sub.group()], sub)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		s.rotation++
+		targets = append(targets, g[s.rotation%len(g)])
+	}
+
+	for _, sub := range targets {
+		sub.c.deliver(sub, subject, reply, header, payload)
+	}
+}
+
+type connectOptions struct {
+	Verbose   bool   `json:"verbose"`
+	User      string `json:"user"`
+	Pass      string `json:"pass"`
+	AuthToken string `json:"auth_token"`
+	Echo      *bool  `json:"echo"`
+	Headers   bool   `json:"headers"`
+}
+
+type serverConn struct {
+	s *Server
+	n net.Conn
+
+	// Guarded by the server lock
+	connected bool
+	verbose   bool
+	echo      bool
+	headers   bool
+	subs      map[string]*serverSub
+
+	// Outgoing frames, written by flush so routing never blocks on a client
+	out     [][]byte
+	outLock sync.Mutex
+	outCond *sync.Cond
+	done    bool
+}
+
+func newServerConn(s *Server, n net.Conn) *serverConn {
+	var c = new(serverConn)
+
+	c.s = s
+	c.n = n
+	c.echo = true
+	c.subs = make(map[string]*serverSub)
+	c.outCond = sync.NewCond(&c.outLock)
+
+	return c
+}
+
+func (c *serverConn) send(format string, args ...interface{}) {
+	c.sendBytes([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (c *serverConn) sendBytes(b []byte) {
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	c.out = append(c.out, b)
+	c.outCond.Signal()
+}
+
+// Write queued frames until the connection is done
+func (c *serverConn) flush() {
+	for {
+		c.outLock.Lock()
+
+		for len(c.out) == 0 && !c.done {
+			c.outCond.Wait()
+		}
+
+		if len(c.out) == 0 {
+			c.outLock.Unlock()
+			return
+		}
+
+		var out = c.out
+		c.out = nil
+
+		c.outLock.Unlock()
+
+		for _, b := range out {
+			if _, e := c.n.Write(b); e != nil {
+				c.stopFlush(true)
+				return
+			}
+		}
+	}
+}
+
+// Have flush return, after writing pending frames unless discard is set
+func (c *serverConn) stopFlush(discard bool) {
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	c.done = true
+	if discard {
+		c.out = nil
+	}
+
+	c.outCond.Signal()
+}
+
+// Expects to be called when the server lock is held
+func (c *serverConn) deliver(sub *serverSub, subject, reply string, header, payload []byte) {
+	var buf bytes.Buffer
+
+	if reply != "" {
+		reply = " " + reply
+	}
+
+	// Subscribers that didn't negotiate headers only get the payload
+	if len(header) > 0 && c.headers {
+		fmt.Fprintf(&buf, "HMSG %s %s%s %d %d\r\n", subject, sub.sid, reply, len(header), len(header)+len(payload))
+		buf.Write(header)
+	} else {
+		fmt.Fprintf(&buf, "MSG %s %s%s %d\r\n", subject, sub.sid, reply, len(payload))
+	}
+
+	buf.Write(payload)
+	buf.WriteString("\r\n")
+
+	c.sendBytes(buf.Bytes())
+
+	sub.received++
+	if sub.max > 0 && sub.received >= sub.max {
+		delete(c.subs, sub.sid)
+	}
+}
+
+func (c *serverConn) info() []byte {
+	var info = map[string]interface{}{
+		"server_id":     c.s.ServerId,
+		"version":       c.s.Version,
+		"auth_required": c.s.authRequired(),
+		"ssl_required":  c.s.TLSRequired,
+		"max_payload":   c.s.MaxPayload,
+		"headers":       c.s.Headers,
+	}
+
+	if c.s.ConnectUrls != nil {
+		info["connect_urls"] = c.s.ConnectUrls
+	}
+
+	b, _ := json.Marshal(info)
+
+	return b
+}
+
+// Send an error and close the connection
+func (c *serverConn) fail(msg string) error {
+	c.send("-ERR '%s'\r\n", msg)
+	return io.EOF
+}
+
+func (c *serverConn) ok() {
+	if c.verbose {
+		c.send("+OK\r\n")
+	}
+}
+
+func (c *serverConn) run() {
+	defer c.stopFlush(false)
+
+	// INFO is written directly, since TLS may need to start right after it
+	_, e := fmt.Fprintf(c.n, "INFO %s\r\n", c.info())
+	if e != nil {
+		return
+	}
+
+	if c.s.TLSRequired {
+		var config = c.s.TLSConfig
+		if config == nil {
+			config = testConfig
+		}
+
+		tc := tls.Server(c.n, config)
+		if tc.Handshake() != nil {
+			return
+		}
+
+		c.s.lock.Lock()
+		c.n = tc
+		c.s.lock.Unlock()
+	}
+
+	var r = bufio.NewReader(c.n)
+
+	for {
+		cmd, e := ReadCommand(r, c.s.MaxPayload)
+
+		switch e {
+		case nil:
+			e = c.handle(cmd)
+		case ErrInvalidCommand:
+			e = c.fail("Invalid Protocol Operation")
+		case ErrPayloadTooLarge:
+			e = c.fail("Maximum Payload Violation")
+		}
+
+		if e != nil {
+			return
+		}
+	}
+}
+
+func (c *serverConn) handle(cmd *Command) error {
+	// CONNECT may only be skipped if no credentials are needed
+	if cmd.Op != "CONNECT" {
+		c.s.lock.Lock()
+		var connected = c.connected || !c.s.authRequired()
+		c.connected = connected
+		c.s.lock.Unlock()
+
+		if !connected {
+			return c.fail("Authorization Violation")
+		}
+	}
+
+	switch cmd.Op {
+	case "CONNECT":
+		return c.connect(cmd)
+	case "PING":
+		c.send("PONG\r\n")
+	case "SUB":
+		c.sub(cmd)
+	case "UNSUB":
+		c.unsub(cmd)
+	case "PUB", "HPUB":
+		return c.pub(cmd)
+	}
+
+	return nil
+}
+
+func (c *serverConn) connect(cmd *Command) error {
+	var o connectOptions
+
+	// Options were parsed generically, decode them into their types
+	b, _ := json.Marshal(cmd.Options)
+	if json.Unmarshal(b, &o) != nil {
+		return c.fail("Invalid CONNECT")
+	}
+
+	var s = c.s
+
+	if s.Username != "" && (o.User != s.Username || o.Pass != s.Password) {
+		return c.fail("Authorization Violation")
+	}
+
+	if s.AuthToken != "" && o.AuthToken != s.AuthToken {
+		return c.fail("Authorization Violation")
+	}
+
+	s.lock.Lock()
+	c.connected = true
+	c.verbose = o.Verbose
+	c.headers = o.Headers && s.Headers
+	if o.Echo != nil {
+		c.echo = *o.Echo
+	}
+	s.lock.Unlock()
+
+	// Only acknowledged in verbose mode, like every other command
+	c.ok()
+
+	return nil
+}
+
+func (c *serverConn) sub(cmd *Command) {
+	var sub = &serverSub{c: c, subject: cmd.Subject, queue: cmd.Queue, sid: cmd.Sid}
+
+	c.s.lock.Lock()
+	c.subs[sub.sid] = sub
+	c.s.lock.Unlock()
+
+	c.ok()
+}
+
+func (c *serverConn) unsub(cmd *Command) {
+	c.s.lock.Lock()
+
+	if sub, ok := c.subs[cmd.Sid]; ok {
+		if cmd.Max > 0 && sub.received < cmd.Max {
+			sub.max = cmd.Max
+		} else {
+			delete(c.subs, cmd.Sid)
+		}
+	}
+
+	c.s.lock.Unlock()
+
+	c.ok()
+}
+
+func (c *serverConn) pub(cmd *Command) error {
+	if cmd.Op == "HPUB" && !c.headers {
+		return c.fail("Headers Not Supported")
+	}
+
+	c.s.lock.Lock()
+	c.s.route(c, cmd.Subject, cmd.ReplyTo, cmd.Header, cmd.Payload)
+	c.s.lock.Unlock()
+
+	c.ok()
+
+	return nil
+}
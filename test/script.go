@@ -0,0 +1,360 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Time a script step waits for the client if the script has no Timeout
+const DefaultStepTimeout = time.Second
+
+// Frames a script commonly sends
+const (
+	FramePing = "PING\r\n"
+	FramePong = "PONG\r\n"
+	FrameOK   = "+OK\r\n"
+)
+
+// MSG frame; reply may be empty
+func Msg(subject, sid, reply, payload string) string {
+	if reply != "" {
+		reply = " " + reply
+	}
+
+	return fmt.Sprintf("MSG %s %s%s %d\r\n%s\r\n", subject, sid, reply, len(payload), payload)
+}
+
+// Condition on a field of a command
+type Matcher struct {
+	field string
+	want  string
+	get   func(c *Command) string
+	match func(got string) bool
+}
+
+func equals(field, want string, get func(c *Command) string) Matcher {
+	return Matcher{field, strconv.Quote(want), get, func(got string) bool { return got == want }}
+}
+
+func matches(field, expr string, get func(c *Command) string) Matcher {
+	var re = regexp.MustCompile(expr)
+
+	return Matcher{field, "~" + strconv.Quote(expr), get, re.MatchString}
+}
+
+func Subject(v string) Matcher {
+	return equals("subject", v, func(c *Command) string { return c.Subject })
+}
+
+func SubjectMatching(expr string) Matcher {
+	return matches("subject", expr, func(c *Command) string { return c.Subject })
+}
+
+func Queue(v string) Matcher {
+	return equals("queue", v, func(c *Command) string { return c.Queue })
+}
+
+func ReplyTo(v string) Matcher {
+	return equals("reply", v, func(c *Command) string { return c.ReplyTo })
+}
+
+func ReplyToMatching(expr string) Matcher {
+	return matches("reply", expr, func(c *Command) string { return c.ReplyTo })
+}
+
+func Sid(v string) Matcher {
+	return equals("sid", v, func(c *Command) string { return c.Sid })
+}
+
+func Max(v int) Matcher {
+	return equals("max", strconv.Itoa(v), func(c *Command) string { return strconv.Itoa(c.Max) })
+}
+
+func Payload(v string) Matcher {
+	return equals("payload", v, func(c *Command) string { return string(c.Payload) })
+}
+
+// Header block of HPUB has a line "key: value"
+func HeaderLine(key, value string) Matcher {
+	var line = key + ": " + value
+
+	return Matcher{"header", strconv.Quote(line), func(c *Command) string { return string(c.Header) },
+		func(got string) bool {
+			for _, l := range strings.Split(got, "\r\n") {
+				if l == line {
+					return true
+				}
+			}
+
+			return false
+		}}
+}
+
+// CONNECT option, compared in its JSON form
+func Option(key string, value interface{}) Matcher {
+	var get = func(c *Command) string {
+		v, ok := c.Options[key]
+		if !ok {
+			return "<missing>"
+		}
+
+		return fmt.Sprint(v)
+	}
+
+	return Matcher{"option " + key, fmt.Sprint(value), get,
+		func(got string) bool { return got == fmt.Sprint(value) }}
+}
+
+// Fields of c that don't match, as "field: want x, got y"
+func mismatches(c *Command, op string, ms []Matcher) []string {
+	var r []string
+
+	if c.Op != op {
+		r = append(r, fmt.Sprintf("op: want %s, got %s", op, c.Op))
+	}
+
+	for _, m := range ms {
+		if got := m.get(c); !m.match(got) {
+			r = append(r, fmt.Sprintf("%s: want %s, got %q", m.field, m.want, got))
+		}
+	}
+
+	return r
+}
+
+type transcriptEntry struct {
+	server  bool
+	text    string
+	command *Command
+}
+
+// Expectation based conversation with a client. Commands are parsed, so it
+// doesn't matter how the client splits or coalesces its writes, and each
+// step expects a command by type and fields. Commands that don't match the
+// current step are kept for later steps, so commands may arrive in any
+// order. Failures report the protocol transcript so far.
+//
+// A script reads everything the client sends; don't mix it with AssertRead.
+type Script struct {
+	t *testing.T
+	n net.Conn
+
+	// Time each step waits for the client, DefaultStepTimeout when zero
+	Timeout time.Duration
+
+	lock sync.Mutex
+
+	// Received commands not matched by a step yet
+	pending []*Command
+
+	// Error that stopped reading, if any
+	err error
+
+	// Signalled whenever a command arrives or reading stops
+	notify chan bool
+
+	transcript []transcriptEntry
+	matched    map[*Command]bool
+}
+
+func NewScript(t *testing.T, n net.Conn) *Script {
+	var sc = new(Script)
+
+	sc.t = t
+	sc.n = n
+	sc.notify = make(chan bool, 1)
+	sc.matched = make(map[*Command]bool)
+
+	go sc.read()
+
+	return sc
+}
+
+// Script reading from the server's connection
+func (s *TestServer) Script() *Script {
+	return NewScript(s.t, s.Conn)
+}
+
+func (sc *Script) read() {
+	var r = bufio.NewReader(sc.n)
+
+	for {
+		c, e := ReadCommand(r, 0)
+
+		sc.lock.Lock()
+
+		if c != nil {
+			sc.pending = append(sc.pending, c)
+			sc.transcript = append(sc.transcript, transcriptEntry{command: c, text: c.String()})
+		}
+
+		// Stop at the first error; the stream can't be parsed past it
+		if e != nil {
+			sc.err = e
+		}
+
+		sc.lock.Unlock()
+
+		select {
+		case sc.notify <- true:
+		default:
+		}
+
+		if e != nil {
+			return
+		}
+	}
+}
+
+func (sc *Script) timeout() time.Duration {
+	if sc.Timeout > 0 {
+		return sc.Timeout
+	}
+
+	return DefaultStepTimeout
+}
+
+// Expect a command of type op with fields matching ms, returns nil and fails
+// the test if none arrives in time
+func (sc *Script) Expect(op string, ms ...Matcher) *Command {
+	return sc.ExpectWithin(sc.timeout(), op, ms...)
+}
+
+func (sc *Script) ExpectWithin(d time.Duration, op string, ms ...Matcher) *Command {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		sc.lock.Lock()
+
+		for i, c := range sc.pending {
+			if len(mismatches(c, op, ms)) == 0 {
+				sc.pending = append(sc.pending[:i:i], sc.pending[i+1:]...)
+				sc.matched[c] = true
+				sc.lock.Unlock()
+
+				return c
+			}
+		}
+
+		var e = sc.err
+
+		sc.lock.Unlock()
+
+		if e != nil {
+			sc.fail(op, ms, fmt.Sprintf("reading stopped: %v", e))
+			return nil
+		}
+
+		select {
+		case <-sc.notify:
+		case <-timer.C:
+			sc.fail(op, ms, fmt.Sprintf("nothing matched within %v", d))
+			return nil
+		}
+	}
+}
+
+// Fail unless the client sends nothing that isn't matched yet within d
+func (sc *Script) ExpectNothing(d time.Duration) bool {
+	time.Sleep(d)
+
+	sc.lock.Lock()
+	var n = len(sc.pending)
+	sc.lock.Unlock()
+
+	if n > 0 {
+		sc.t.Errorf("Expected nothing, got unmatched commands\n%s", sc.Transcript())
+		return false
+	}
+
+	return true
+}
+
+// Write frames to the client, in one write
+func (sc *Script) Send(frames ...string) bool {
+	var b = strings.Join(frames, "")
+
+	sc.lock.Lock()
+	sc.transcript = append(sc.transcript, transcriptEntry{server: true, text: strings.TrimSuffix(b, "\r\n")})
+	sc.lock.Unlock()
+
+	if _, e := sc.n.Write([]byte(b)); e != nil {
+		sc.t.Errorf("Error: %#v\n%s", e, sc.Transcript())
+		return false
+	}
+
+	return true
+}
+
+// Conversation so far: C for client commands, S for server frames; a ? marks
+// commands no step matched
+func (sc *Script) Transcript() string {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	var buf bytes.Buffer
+
+	for _, e := range sc.transcript {
+		var prefix = "C "
+
+		if e.server {
+			prefix = "S "
+		} else if !sc.matched[e.command] {
+			prefix = "C?"
+		}
+
+		for _, line := range strings.Split(e.text, "\r\n") {
+			fmt.Fprintf(&buf, "  %s %s\n", prefix, line)
+			prefix = "  "
+		}
+	}
+
+	return buf.String()
+}
+
+func (sc *Script) fail(op string, ms []Matcher, reason string) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Expected %s", op)
+	for _, m := range ms {
+		fmt.Fprintf(&buf, " %s=%s", m.field, m.want)
+	}
+
+	fmt.Fprintf(&buf, ": %s\n", reason)
+
+	sc.lock.Lock()
+	var pending = append([]*Command(nil), sc.pending...)
+	sc.lock.Unlock()
+
+	// Show how the unmatched commands of the same type differ
+	var header bool
+	for _, c := range pending {
+		if c.Op != op {
+			continue
+		}
+
+		if !header {
+			buf.WriteString("unmatched candidates:\n")
+			header = true
+		}
+
+		fmt.Fprintf(&buf, "  %s\n", c)
+		for _, m := range mismatches(c, op, ms) {
+			fmt.Fprintf(&buf, "    %s\n", m)
+		}
+	}
+
+	buf.WriteString("transcript:\n")
+	buf.WriteString(sc.Transcript())
+
+	sc.t.Error(buf.String())
+}
@@ -3,6 +3,7 @@ package test
 import (
 	"bytes"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"math/big"
@@ -100,7 +101,18 @@ func (s *TestServer) Close() {
 }
 
 func (s *TestServer) StartTLS() {
-	s.Conn = tls.Server(s.Conn, testConfig)
+	s.StartTLSWith(testConfig)
+}
+
+// Upgrade to TLS with a configuration such as CA.ServerConfig
+func (s *TestServer) StartTLSWith(config *tls.Config) {
+	s.Conn = tls.Server(s.Conn, config)
+}
+
+// SHA-256 fingerprint of the certificate presented after StartTLS
+func CertificateFingerprint() []byte {
+	var sum = sha256.Sum256(testCertificate)
+	return sum[:]
 }
 
 // Following code copied from go/src/pkg/crypto/tls/handshake_server_test.go
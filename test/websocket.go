@@ -0,0 +1,461 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var ErrWebSocketFrame = errors.New("test: invalid websocket frame")
+
+// Largest message the bridge accepts from a client
+const MaxWebSocketMessage = 4 * DefaultMaxPayload
+
+// WebSocket endpoint on a loopback port, implementing the server side of
+// RFC 6455 with optional permessage-deflate, independently of the client
+// package. Every connection is bridged to a connection of Upstream, such as
+// one to a Server, or echoes data messages if there is no Upstream.
+// Configure the bridge before Listen.
+type WebSocketBridge struct {
+	Upstream interface {
+		Dial() (net.Conn, error)
+	}
+
+	// Accept permessage-deflate if the client offers it
+	Compression bool
+
+	// Serve wss:// instead of ws://
+	TLSConfig *tls.Config
+
+	// Fragment messages to clients into frames of at most this many bytes,
+	// if positive
+	FrameSize int
+
+	// Send a ping before every data frame, to check clients answer control
+	// frames in between fragments
+	Ping bool
+
+	// Refuse the upgrade with this status, if set, like a misconfigured load
+	// balancer would
+	Status int
+
+	lock     sync.Mutex
+	l        net.Listener
+	conns    map[net.Conn]bool
+	requests []*http.Request
+	pongs    int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewWebSocketBridge() *WebSocketBridge {
+	var b = new(WebSocketBridge)
+
+	b.conns = make(map[net.Conn]bool)
+
+	return b
+}
+
+// Accept clients on a loopback port, returns the ws:// or wss:// URL to dial
+func (b *WebSocketBridge) Listen() (string, error) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		return "", e
+	}
+
+	var scheme = "ws"
+	if b.TLSConfig != nil {
+		l = tls.NewListener(l, b.TLSConfig)
+		scheme = "wss"
+	}
+
+	b.lock.Lock()
+	b.l = l
+	b.lock.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		for {
+			n, e := l.Accept()
+			if e != nil {
+				return
+			}
+
+			b.track(n, true)
+
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				defer b.track(n, false)
+
+				b.serve(n)
+			}()
+		}
+	}()
+
+	return fmt.Sprintf("%s://%s/", scheme, l.Addr()), nil
+}
+
+func (b *WebSocketBridge) track(n net.Conn, add bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !add {
+		delete(b.conns, n)
+		n.Close()
+		return
+	}
+
+	if b.closed {
+		n.Close()
+		return
+	}
+
+	b.conns[n] = true
+}
+
+// Close the listener and all connections, and wait for them
+func (b *WebSocketBridge) Close() {
+	b.lock.Lock()
+
+	b.closed = true
+
+	if b.l != nil {
+		b.l.Close()
+	}
+
+	for n := range b.conns {
+		n.Close()
+	}
+
+	b.lock.Unlock()
+
+	b.wg.Wait()
+}
+
+// Opening requests received so far, to check their headers
+func (b *WebSocketBridge) Requests() []*http.Request {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]*http.Request(nil), b.requests...)
+}
+
+// Pongs received in answer to Ping
+func (b *WebSocketBridge) Pongs() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.pongs
+}
+
+func (b *WebSocketBridge) serve(n net.Conn) {
+	var r = bufio.NewReader(n)
+
+	req, e := http.ReadRequest(r)
+	if e != nil {
+		return
+	}
+
+	b.lock.Lock()
+	b.requests = append(b.requests, req)
+	b.lock.Unlock()
+
+	var key = req.Header.Get("Sec-WebSocket-Key")
+
+	if b.Status != 0 {
+		fmt.Fprintf(n, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", b.Status, http.StatusText(b.Status))
+		return
+	}
+
+	if req.Method != "GET" || key == "" || req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		fmt.Fprintf(n, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	var c = &bridgeConn{b: b, n: n, r: r}
+	var ext string
+
+	if b.Compression && strings.Contains(req.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		c.deflate = true
+		ext = "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+
+	var sum = sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+	fmt.Fprintf(n, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n%s\r\n", base64.StdEncoding.EncodeToString(sum[:]), ext)
+
+	if b.Upstream == nil {
+		for {
+			m, e := c.readMessage()
+			if e != nil {
+				return
+			}
+
+			if c.writeMessage(m) != nil {
+				return
+			}
+		}
+	}
+
+	u, e := b.Upstream.Dial()
+	if e != nil {
+		c.writeFrame(wsClose, []byte{0x03, 0xf3}, false)
+		return
+	}
+
+	defer u.Close()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		var buf = make([]byte, 32*1024)
+
+		for {
+			k, e := u.Read(buf)
+			if k > 0 && c.writeMessage(buf[:k]) != nil {
+				break
+			}
+
+			if e != nil {
+				break
+			}
+		}
+
+		c.writeFrame(wsClose, []byte{0x03, 0xe8}, false)
+		n.Close()
+	}()
+
+	for {
+		m, e := c.readMessage()
+		if e != nil {
+			return
+		}
+
+		if _, e = u.Write(m); e != nil {
+			return
+		}
+	}
+}
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var deflateTrailer = []byte{0x00, 0x00, 0xff, 0xff}
+
+// Server end of a bridged connection
+type bridgeConn struct {
+	b *WebSocketBridge
+	n net.Conn
+	r *bufio.Reader
+
+	wLock   sync.Mutex
+	deflate bool
+}
+
+// Next data message, answering control frames
+func (c *bridgeConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var started, compressed bool
+
+	for {
+		var h [8]byte
+
+		if _, e := io.ReadFull(c.r, h[:2]); e != nil {
+			return nil, e
+		}
+
+		var fin = h[0]&0x80 != 0
+		var rsv1 = h[0]&0x40 != 0
+		var op = h[0] & 0x0f
+		var size = uint64(h[1] & 0x7f)
+
+		// Clients always mask
+		if h[1]&0x80 == 0 || h[0]&0x30 != 0 || (rsv1 && !c.deflate) {
+			return nil, ErrWebSocketFrame
+		}
+
+		switch size {
+		case 126:
+			if _, e := io.ReadFull(c.r, h[:2]); e != nil {
+				return nil, e
+			}
+
+			size = uint64(binary.BigEndian.Uint16(h[:2]))
+		case 127:
+			if _, e := io.ReadFull(c.r, h[:8]); e != nil {
+				return nil, e
+			}
+
+			size = binary.BigEndian.Uint64(h[:8])
+		}
+
+		if size > MaxWebSocketMessage || len(msg)+int(size) > MaxWebSocketMessage {
+			return nil, ErrPayloadTooLarge
+		}
+
+		var mask [4]byte
+		if _, e := io.ReadFull(c.r, mask[:]); e != nil {
+			return nil, e
+		}
+
+		var payload = make([]byte, size)
+		if _, e := io.ReadFull(c.r, payload); e != nil {
+			return nil, e
+		}
+
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload, false)
+			continue
+		case wsPong:
+			c.b.lock.Lock()
+			c.b.pongs++
+			c.b.lock.Unlock()
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload, false)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, ErrWebSocketFrame
+			}
+
+			started = true
+			compressed = rsv1
+		case wsContinuation:
+			if !started {
+				return nil, ErrWebSocketFrame
+			}
+		default:
+			return nil, ErrWebSocketFrame
+		}
+
+		msg = append(msg, payload...)
+
+		if fin {
+			break
+		}
+	}
+
+	if !compressed {
+		return msg, nil
+	}
+
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(msg), bytes.NewReader(deflateTrailer)))
+	defer fr.Close()
+
+	out, e := io.ReadAll(io.LimitReader(fr, MaxWebSocketMessage))
+	if e != nil && e != io.ErrUnexpectedEOF {
+		return nil, ErrWebSocketFrame
+	}
+
+	return out, nil
+}
+
+// Send m as a binary message, compressed if negotiated, fragmented if the
+// bridge has a FrameSize
+func (c *bridgeConn) writeMessage(m []byte) error {
+	if c.deflate {
+		var buf bytes.Buffer
+
+		fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		fw.Write(m)
+		fw.Flush()
+
+		m = bytes.TrimSuffix(buf.Bytes(), deflateTrailer)
+	}
+
+	var op byte = wsBinary
+
+	for first := true; first || len(m) > 0; first = false {
+		var chunk = m
+		if c.b.FrameSize > 0 && len(chunk) > c.b.FrameSize {
+			chunk = chunk[:c.b.FrameSize]
+		}
+
+		m = m[len(chunk):]
+
+		if c.b.Ping {
+			if e := c.writeFrame(wsPing, []byte("bridge"), false); e != nil {
+				return e
+			}
+		}
+
+		var b0 = op
+		if len(m) == 0 {
+			b0 |= 0x80
+		}
+
+		if e := c.writeFrame(b0, chunk, first && c.deflate); e != nil {
+			return e
+		}
+
+		op = wsContinuation
+	}
+
+	return nil
+}
+
+// Write an unmasked frame; the FIN bit is set for control frames, and taken
+// from op otherwise
+func (c *bridgeConn) writeFrame(op byte, payload []byte, rsv1 bool) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	var buf = make([]byte, 0, 10+len(payload))
+
+	var b0 = op
+	if op&0x0f >= wsClose {
+		b0 |= 0x80
+	}
+
+	if rsv1 {
+		b0 |= 0x40
+	}
+
+	buf = append(buf, b0)
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	buf = append(buf, payload...)
+
+	_, e := c.n.Write(buf)
+
+	return e
+}
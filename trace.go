@@ -0,0 +1,162 @@
+package nats
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidTraceparent = errors.New("nats: invalid traceparent")
+)
+
+// Header carrying the trace context, as in W3C Trace Context
+const TraceparentHeader = "traceparent"
+
+// Sampled flag of the trace flags
+const TraceSampled byte = 0x01
+
+// Messages published without headers carry their trace context in front of
+// the payload: the prefix, the traceparent and CRLF
+var traceEnvelopePrefix = []byte("\x00traceparent ")
+
+// Length of a version 00 traceparent
+const traceparentSize = 55
+
+// Position of a message in a trace, as in the W3C traceparent header. The
+// zero value means the message is not part of a trace.
+type TraceContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+}
+
+// Whether the context identifies a trace; IDs may not be all zeros
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceId != [16]byte{} && tc.SpanId != [8]byte{}
+}
+
+// Whether the trace is sampled
+func (tc TraceContext) IsSampled() bool {
+	return tc.Flags&TraceSampled != 0
+}
+
+// Format as traceparent, version 00
+func (tc TraceContext) String() string {
+	return "00-" + hex.EncodeToString(tc.TraceId[:]) + "-" +
+		hex.EncodeToString(tc.SpanId[:]) + "-" + hex.EncodeToString([]byte{tc.Flags})
+}
+
+// Parse a traceparent; fields after the flags of future versions are ignored
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	var parts = strings.Split(s, "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, ErrInvalidTraceparent
+	}
+
+	// Version 00 has exactly four fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, ErrInvalidTraceparent
+	}
+
+	var flags [1]byte
+	var fields = []struct {
+		s string
+		b []byte
+	}{
+		{parts[0], make([]byte, 1)},
+		{parts[1], tc.TraceId[:]},
+		{parts[2], tc.SpanId[:]},
+		{parts[3], flags[:]},
+	}
+
+	for _, f := range fields {
+		// Upper case hex is not allowed
+		if len(f.s) != 2*len(f.b) || strings.ToLower(f.s) != f.s {
+			return TraceContext{}, ErrInvalidTraceparent
+		}
+
+		if _, e := hex.Decode(f.b, []byte(f.s)); e != nil {
+			return TraceContext{}, ErrInvalidTraceparent
+		}
+	}
+
+	tc.Flags = flags[0]
+
+	if !tc.IsValid() {
+		return TraceContext{}, ErrInvalidTraceparent
+	}
+
+	return tc, nil
+}
+
+// Context for a new span: a child of parent if it is valid, the root of a new
+// sampled trace otherwise
+func NewSpan(parent TraceContext) TraceContext {
+	var tc = parent
+
+	if !parent.IsValid() {
+		rand.Read(tc.TraceId[:])
+		tc.Flags = TraceSampled
+	}
+
+	rand.Read(tc.SpanId[:])
+
+	return tc
+}
+
+// Hook around publishing and delivering messages, to propagate trace context
+// from publishers to subscribers.
+type Tracer interface {
+	// Called before publishing on subject, with the context of the message
+	// being published in response to, if any. Returns the context to send
+	// along with the message; a zero context sends none.
+	Publish(subject string, parent TraceContext) TraceContext
+
+	// Called before a message that carried trace context is delivered
+	Deliver(subject string, tc TraceContext)
+}
+
+// Wrap payload in an envelope carrying the trace context
+func traceEnvelope(tc TraceContext, m []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.Grow(len(traceEnvelopePrefix) + traceparentSize + 2 + len(m))
+	buf.Write(traceEnvelopePrefix)
+	buf.WriteString(tc.String())
+	buf.WriteString("\r\n")
+	buf.Write(m)
+
+	return buf.Bytes()
+}
+
+// Take trace context from the header or envelope of a message, removing the
+// envelope from the payload
+func extractTrace(m *readMessage) {
+	if v := m.Header.Get(TraceparentHeader); v != "" {
+		if tc, e := ParseTraceparent(v); e == nil {
+			m.Trace = tc
+		}
+
+		return
+	}
+
+	var p = m.Payload
+	var n = len(traceEnvelopePrefix) + traceparentSize
+
+	if !bytes.HasPrefix(p, traceEnvelopePrefix) || len(p) < n+2 || string(p[n:n+2]) != "\r\n" {
+		return
+	}
+
+	var tc, e = ParseTraceparent(string(p[len(traceEnvelopePrefix):n]))
+	if e != nil {
+		return
+	}
+
+	m.Trace = tc
+	m.Payload = p[n+2:]
+}
@@ -0,0 +1,106 @@
+package nats
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testTraceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	tc, e := ParseTraceparent(testTraceparent)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if !tc.IsValid() || !tc.IsSampled() {
+		t.Errorf("Expected valid sampled context, got %#v", tc)
+	}
+
+	if tc.String() != testTraceparent {
+		t.Errorf("Expected %s, got %s", testTraceparent, tc.String())
+	}
+}
+
+func TestParseTraceparentInvalid(t *testing.T) {
+	var invalid = []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-00",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+	}
+
+	for _, s := range invalid {
+		if _, e := ParseTraceparent(s); e != ErrInvalidTraceparent {
+			t.Errorf("Expected error for %#v, got %#v", s, e)
+		}
+	}
+}
+
+func TestParseTraceparentFutureVersion(t *testing.T) {
+	_, e := ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra")
+	if e != nil {
+		t.Errorf("Expected fields of future versions to be ignored, got %#v", e)
+	}
+}
+
+func TestNewSpan(t *testing.T) {
+	root := NewSpan(TraceContext{})
+	if !root.IsValid() || !root.IsSampled() {
+		t.Errorf("Expected valid sampled root, got %#v", root)
+	}
+
+	child := NewSpan(root)
+	if child.TraceId != root.TraceId {
+		t.Errorf("Expected child to keep the trace id")
+	}
+
+	if child.SpanId == root.SpanId {
+		t.Errorf("Expected child to have a new span id")
+	}
+}
+
+func TestExtractTraceFromEnvelope(t *testing.T) {
+	tc, _ := ParseTraceparent(testTraceparent)
+
+	m := &readMessage{Payload: traceEnvelope(tc, []byte("message"))}
+	extractTrace(m)
+
+	if m.Trace != tc {
+		t.Errorf("Expected %#v, got %#v", tc, m.Trace)
+	}
+
+	if !bytes.Equal(m.Payload, []byte("message")) {
+		t.Errorf("Expected envelope to be removed, got %#v", string(m.Payload))
+	}
+}
+
+func TestExtractTraceFromHeader(t *testing.T) {
+	tc, _ := ParseTraceparent(testTraceparent)
+
+	m := &readMessage{Header: Header{}, Payload: []byte("message")}
+	m.Header.Set(TraceparentHeader, testTraceparent)
+	extractTrace(m)
+
+	if m.Trace != tc {
+		t.Errorf("Expected %#v, got %#v", tc, m.Trace)
+	}
+}
+
+func TestExtractTraceWithoutContext(t *testing.T) {
+	m := &readMessage{Payload: []byte("\x00traceparent garbage\r\n")}
+	extractTrace(m)
+
+	if m.Trace.IsValid() {
+		t.Errorf("Expected no trace context, got %#v", m.Trace)
+	}
+
+	if string(m.Payload) != "\x00traceparent garbage\r\n" {
+		t.Errorf("Expected payload to be untouched, got %#v", string(m.Payload))
+	}
+}
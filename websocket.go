@@ -0,0 +1,554 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWebSocketHandshake = errors.New("nats: websocket handshake failed")
+	ErrWebSocketFrame     = errors.New("nats: invalid websocket frame")
+	ErrWebSocketTooLarge  = errors.New("nats: websocket message too large")
+)
+
+// Time the opening handshake may take if a WebSocketDialer has no Timeout
+const DefaultWebSocketTimeout = 5 * time.Second
+
+// Largest message accepted from the server, before and after decompression
+const MaxWebSocketMessage = 2 * MaxReadPayload
+
+// Appended to every key by the server to prove it speaks WebSocket
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Trailer a sync flush ends with, which permessage-deflate leaves out
+var deflateTrailer = []byte{0x00, 0x00, 0xff, 0xff}
+
+// Dials a server over WebSocket, for when it can only be reached through an
+// HTTP load balancer. The protocol stream is carried in binary messages, and
+// the connection is a net.Conn, so handshakes work as over TCP.
+type WebSocketDialer struct {
+	// ws:// or wss:// URL of the server
+	URL string
+
+	// Extra headers for the opening request, such as credentials for a proxy
+	Header http.Header
+
+	// Configuration of wss:// connections; the server name defaults to the
+	// host of the URL
+	TLSConfig *tls.Config
+
+	// Offer permessage-deflate, without context takeover in either direction.
+	// Used only if the server accepts it.
+	Compression bool
+
+	// Time the opening handshake may take, DefaultWebSocketTimeout when zero
+	Timeout time.Duration
+
+	// Dials the TCP connection, net.Dial if nil
+	NetDial func(network, addr string) (net.Conn, error)
+}
+
+func (d WebSocketDialer) Dial() (net.Conn, error) {
+	return d.dial(d.URL)
+}
+
+// Dial w.URL over WebSocket with the headers, TLS and compression of w,
+// retrying like DefaultDialer
+func DefaultWebSocketDialer(w WebSocketDialer) Dialer {
+	var d = defaultRetryingDialer()
+
+	d.f = w.dial
+	d.Addr = w.URL
+
+	return d
+}
+
+func (d WebSocketDialer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+
+	return DefaultWebSocketTimeout
+}
+
+func (d WebSocketDialer) dial(rawurl string) (net.Conn, error) {
+	u, e := url.Parse(rawurl)
+	if e != nil {
+		return nil, e
+	}
+
+	var addr = u.Host
+	var secure bool
+
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, errors.New("nats: websocket URL must be ws:// or wss://")
+	}
+
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var dial = d.NetDial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	n, e := dial("tcp", addr)
+	if e != nil {
+		return nil, e
+	}
+
+	n.SetDeadline(time.Now().Add(d.timeout()))
+
+	if secure {
+		var config = new(tls.Config)
+		if d.TLSConfig != nil {
+			config = d.TLSConfig.Clone()
+		}
+
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+
+		tc := tls.Client(n, config)
+
+		e = tc.Handshake()
+		if e != nil {
+			n.Close()
+			return nil, e
+		}
+
+		n = tc
+	}
+
+	c, e := d.handshake(n, u)
+	if e != nil {
+		n.Close()
+		return nil, e
+	}
+
+	n.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func webSocketAccept(key string) string {
+	var sum = sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Opening handshake of RFC 6455, section 4.1
+func (d WebSocketDialer) handshake(n net.Conn, u *url.URL) (net.Conn, error) {
+	var nonce = make([]byte, 16)
+	if _, e := rand.Read(nonce); e != nil {
+		return nil, e
+	}
+
+	var key = base64.StdEncoding.EncodeToString(nonce)
+
+	var req = &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+
+	for k, v := range d.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if d.Compression {
+		req.Header.Set("Sec-WebSocket-Extensions",
+			"permessage-deflate; client_no_context_takeover; server_no_context_takeover")
+	}
+
+	if e := req.Write(n); e != nil {
+		return nil, e
+	}
+
+	var r = bufio.NewReader(n)
+
+	res, e := http.ReadResponse(r, req)
+	if e != nil {
+		return nil, e
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &ProtocolError{Expected: "101 Switching Protocols", Received: res.Status}
+	}
+
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(res.Header, "Connection", "upgrade") ||
+		res.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, ErrWebSocketHandshake
+	}
+
+	var c = &webSocketConn{Conn: n, r: r, host: u.Hostname()}
+
+	for _, ext := range res.Header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(ext, ",") {
+			var params = strings.Split(offer, ";")
+
+			// Only what was offered may be accepted
+			if !d.Compression || strings.TrimSpace(params[0]) != "permessage-deflate" || c.deflate {
+				return nil, ErrWebSocketHandshake
+			}
+
+			var noServerTakeover bool
+			for _, p := range params[1:] {
+				switch strings.TrimSpace(p) {
+				case "server_no_context_takeover":
+					noServerTakeover = true
+				case "client_no_context_takeover":
+				default:
+					return nil, ErrWebSocketHandshake
+				}
+			}
+
+			// Every message is inflated on its own
+			if !noServerTakeover {
+				return nil, ErrWebSocketHandshake
+			}
+
+			c.deflate = true
+		}
+	}
+
+	return c, nil
+}
+
+// Whether a comma separated header has token, ignoring case
+func headerContains(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Client end of a WebSocket connection, reading and writing the payload of
+// data messages as a stream. Control frames are handled while reading.
+type webSocketConn struct {
+	net.Conn
+
+	r *bufio.Reader
+
+	// Host of the URL, for TLS inside the session
+	host string
+
+	// Unread part of the current message
+	msg []byte
+
+	// Guards writing frames, which the reader also does for control frames
+	wLock sync.Mutex
+
+	// Whether the close handshake started
+	closing bool
+
+	deflate bool
+	fw      *flate.Writer
+}
+
+func (c *webSocketConn) DialedHost() string {
+	return c.host
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for len(c.msg) == 0 {
+		m, e := c.readMessage()
+		if e != nil {
+			return 0, e
+		}
+
+		c.msg = m
+	}
+
+	var n = copy(b, c.msg)
+	c.msg = c.msg[n:]
+
+	return n, nil
+}
+
+// Next data message, answering control frames that come before and in
+// between its fragments
+func (c *webSocketConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var started, compressed bool
+
+	for {
+		fin, rsv1, op, payload, e := c.readFrame()
+		if e != nil {
+			return nil, e
+		}
+
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload, false)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the status code, and stop reading
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+
+			c.writeClose(payload)
+
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, ErrWebSocketFrame
+			}
+
+			started = true
+			compressed = rsv1
+		case wsContinuation:
+			if !started || rsv1 {
+				return nil, ErrWebSocketFrame
+			}
+		default:
+			return nil, ErrWebSocketFrame
+		}
+
+		if len(msg)+len(payload) > MaxWebSocketMessage {
+			return nil, ErrWebSocketTooLarge
+		}
+
+		msg = append(msg, payload...)
+
+		if fin {
+			break
+		}
+	}
+
+	if compressed {
+		return inflate(msg)
+	}
+
+	return msg, nil
+}
+
+func (c *webSocketConn) readFrame() (fin, rsv1 bool, op byte, payload []byte, e error) {
+	var h [8]byte
+
+	if _, e = io.ReadFull(c.r, h[:2]); e != nil {
+		return
+	}
+
+	fin = h[0]&0x80 != 0
+	rsv1 = h[0]&0x40 != 0
+	op = h[0] & 0x0f
+
+	var masked = h[1]&0x80 != 0
+	var size = uint64(h[1] & 0x7f)
+
+	// Servers don't mask, and only extensions set reserved bits
+	if masked || h[0]&0x30 != 0 || (rsv1 && !c.deflate) {
+		e = ErrWebSocketFrame
+		return
+	}
+
+	switch size {
+	case 126:
+		if _, e = io.ReadFull(c.r, h[:2]); e != nil {
+			return
+		}
+
+		size = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, e = io.ReadFull(c.r, h[:8]); e != nil {
+			return
+		}
+
+		size = binary.BigEndian.Uint64(h[:8])
+	}
+
+	// Control frames are short and never fragmented
+	if op >= wsClose && (size > 125 || !fin || rsv1) {
+		e = ErrWebSocketFrame
+		return
+	}
+
+	if size > MaxWebSocketMessage {
+		e = ErrWebSocketTooLarge
+		return
+	}
+
+	payload = make([]byte, size)
+	_, e = io.ReadFull(c.r, payload)
+
+	return
+}
+
+func inflate(b []byte) ([]byte, error) {
+	var fr = flate.NewReader(io.MultiReader(bytes.NewReader(b), bytes.NewReader(deflateTrailer)))
+	defer fr.Close()
+
+	// Read one byte more than allowed, to tell a message that is too large
+	out, e := io.ReadAll(io.LimitReader(fr, MaxWebSocketMessage+1))
+	if e != nil && e != io.ErrUnexpectedEOF {
+		return nil, ErrWebSocketFrame
+	}
+
+	if len(out) > MaxWebSocketMessage {
+		return nil, ErrWebSocketTooLarge
+	}
+
+	return out, nil
+}
+
+// Every write is sent as one binary message
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+
+	var payload = b
+	var compressed bool
+
+	if c.deflate {
+		var buf bytes.Buffer
+		var e error
+
+		if c.fw == nil {
+			c.fw, e = flate.NewWriter(&buf, flate.BestSpeed)
+			if e != nil {
+				return 0, e
+			}
+		} else {
+			c.fw.Reset(&buf)
+		}
+
+		c.fw.Write(b)
+		c.fw.Flush()
+
+		payload = bytes.TrimSuffix(buf.Bytes(), deflateTrailer)
+		compressed = true
+	}
+
+	if e := c.writeFrameLocked(wsBinary, payload, compressed); e != nil {
+		return 0, e
+	}
+
+	return len(b), nil
+}
+
+func (c *webSocketConn) writeFrame(op byte, payload []byte, rsv1 bool) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	return c.writeFrameLocked(op, payload, rsv1)
+}
+
+// Expects to be called when the write lock is held. Client frames are
+// masked with a fresh key.
+func (c *webSocketConn) writeFrameLocked(op byte, payload []byte, rsv1 bool) error {
+	var buf = make([]byte, 0, 14+len(payload))
+
+	var b0 = 0x80 | op
+	if rsv1 {
+		b0 |= 0x40
+	}
+
+	buf = append(buf, b0)
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	var mask [4]byte
+	if _, e := rand.Read(mask[:]); e != nil {
+		return e
+	}
+
+	buf = append(buf, mask[:]...)
+
+	for i, v := range payload {
+		buf = append(buf, v^mask[i%4])
+	}
+
+	_, e := c.Conn.Write(buf)
+
+	return e
+}
+
+// Send a close frame unless one was sent already
+func (c *webSocketConn) writeClose(payload []byte) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if c.closing {
+		return
+	}
+
+	c.closing = true
+
+	// Don't wait long for a peer that stopped reading
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrameLocked(wsClose, payload, false)
+}
+
+// Start the close handshake with status 1000, and close the connection
+// without waiting for the reply
+func (c *webSocketConn) Close() error {
+	c.writeClose([]byte{0x03, 0xe8})
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,244 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/gonats/test"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startBridge(t *testing.T, configure func(b *test.WebSocketBridge)) (*test.WebSocketBridge, string) {
+	var b = test.NewWebSocketBridge()
+	if configure != nil {
+		configure(b)
+	}
+
+	url, e := b.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return b, url
+}
+
+// Write m and read it back from an echoing bridge
+func testWebSocketEcho(t *testing.T, n net.Conn, m []byte) {
+	go n.Write(m)
+
+	var buf = make([]byte, len(m))
+
+	n.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := io.ReadFull(n, buf); e != nil {
+		t.Fatal(e)
+	}
+
+	if !bytes.Equal(buf, m) {
+		t.Errorf("Expected %d bytes echoed, got %q", len(m), buf)
+	}
+}
+
+func TestWebSocketDialerEcho(t *testing.T) {
+	b, url := startBridge(t, nil)
+	defer b.Close()
+
+	var d = WebSocketDialer{URL: url, Header: http.Header{"Authorization": {"Bearer token"}}}
+
+	n, e := d.Dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer n.Close()
+
+	if dh, ok := n.(DialedHoster); !ok || dh.DialedHost() != "127.0.0.1" {
+		t.Errorf("Expected the URL host to be the dialed host, got %#v", n)
+	}
+
+	testWebSocketEcho(t, n, []byte("PING\r\n"))
+	testWebSocketEcho(t, n, bytes.Repeat([]byte("x"), 70000))
+
+	var r = b.Requests()
+	if len(r) != 1 || r[0].Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("Expected the extra header in the request, got %#v", r)
+	}
+
+	if ext := r[0].Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Errorf("Expected no extensions offered, got %s", ext)
+	}
+}
+
+func TestWebSocketDialerCompression(t *testing.T) {
+	b, url := startBridge(t, func(b *test.WebSocketBridge) {
+		b.Compression = true
+	})
+
+	defer b.Close()
+
+	n, e := WebSocketDialer{URL: url, Compression: true}.Dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer n.Close()
+
+	if !n.(*webSocketConn).deflate {
+		t.Errorf("Expected permessage-deflate to be negotiated")
+	}
+
+	testWebSocketEcho(t, n, []byte("MSG foo 1 2\r\nhi\r\n"))
+	testWebSocketEcho(t, n, bytes.Repeat([]byte("compressible "), 10000))
+	testWebSocketEcho(t, n, nil)
+}
+
+func TestWebSocketDialerCompressionDeclined(t *testing.T) {
+	b, url := startBridge(t, nil)
+	defer b.Close()
+
+	n, e := WebSocketDialer{URL: url, Compression: true}.Dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer n.Close()
+
+	if n.(*webSocketConn).deflate {
+		t.Errorf("Expected no compression if the server declines it")
+	}
+
+	testWebSocketEcho(t, n, []byte("hi"))
+}
+
+func TestWebSocketDialerFragmentsAndPings(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		b, url := startBridge(t, func(b *test.WebSocketBridge) {
+			b.FrameSize = 3
+			b.Ping = true
+			b.Compression = compression
+		})
+
+		n, e := WebSocketDialer{URL: url, Compression: compression}.Dial()
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		testWebSocketEcho(t, n, []byte("fragmented in between pings"))
+
+		// The bridge reads the pongs after it sent the message
+		test.WaitFor(t, time.Second, "pongs", func() bool { return b.Pongs() > 0 })
+
+		n.Close()
+		b.Close()
+	}
+}
+
+func TestWebSocketDialerRefused(t *testing.T) {
+	b, url := startBridge(t, func(b *test.WebSocketBridge) {
+		b.Status = http.StatusBadGateway
+	})
+
+	defer b.Close()
+
+	_, e := WebSocketDialer{URL: url}.Dial()
+
+	var pe *ProtocolError
+	if !errors.As(e, &pe) || pe.Received != "502 Bad Gateway" {
+		t.Errorf("Expected protocol error, got %#v", e)
+	}
+}
+
+// Serve one upgrade with a fixed response
+func serveWebSocketResponse(t *testing.T, response string) string {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	go func() {
+		defer l.Close()
+
+		n, e := l.Accept()
+		if e != nil {
+			return
+		}
+
+		defer n.Close()
+
+		http.ReadRequest(bufio.NewReader(n))
+		io.WriteString(n, response)
+	}()
+
+	return fmt.Sprintf("ws://%s/", l.Addr())
+}
+
+func TestWebSocketDialerWrongAccept(t *testing.T) {
+	url := serveWebSocketResponse(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: d3Jvbmc=\r\n\r\n")
+
+	if _, e := (WebSocketDialer{URL: url}).Dial(); e != ErrWebSocketHandshake {
+		t.Errorf("Expected ErrWebSocketHandshake, got %#v", e)
+	}
+}
+
+func TestWebSocketDialerTimeout(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer l.Close()
+
+	// Accepted by the kernel, never answered
+	_, e = WebSocketDialer{URL: fmt.Sprintf("ws://%s/", l.Addr()), Timeout: 10 * time.Millisecond}.Dial()
+
+	var ne net.Error
+	if !errors.As(e, &ne) || !ne.Timeout() {
+		t.Errorf("Expected timeout, got %#v", e)
+	}
+}
+
+func TestWebSocketDialerInvalidURL(t *testing.T) {
+	if _, e := (WebSocketDialer{URL: "http://127.0.0.1/"}).Dial(); e == nil || !strings.Contains(e.Error(), "ws://") {
+		t.Errorf("Expected error for http URL, got %#v", e)
+	}
+}
+
+func TestWebSocketConnReadsCloseAsEOF(t *testing.T) {
+	nc, ns := net.Pipe()
+	defer ns.Close()
+
+	var c = &webSocketConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	go func() {
+		// Unmasked close frame with status 1001, then read the reply
+		ns.Write([]byte{0x88, 0x02, 0x03, 0xe9})
+		io.ReadFull(ns, make([]byte, 8))
+	}()
+
+	if _, e := c.Read(make([]byte, 1)); e != io.EOF {
+		t.Errorf("Expected EOF, got %#v", e)
+	}
+
+	if _, e := c.Write([]byte("x")); e == nil {
+		t.Errorf("Expected writes to fail after close")
+	}
+}
+
+func TestWebSocketConnRejectsMaskedFrames(t *testing.T) {
+	nc, ns := net.Pipe()
+	defer ns.Close()
+
+	var c = &webSocketConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	go ns.Write([]byte{0x82, 0x81, 0, 0, 0, 0, 'x'})
+
+	if _, e := c.Read(make([]byte, 1)); e != ErrWebSocketFrame {
+		t.Errorf("Expected ErrWebSocketFrame, got %#v", e)
+	}
+}
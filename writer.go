@@ -31,10 +31,17 @@ func writeAndFlush(wr *bufio.Writer, wobj writeObject) error {
 }
 
 type writeConnect struct {
-	Verbose  bool   `json:"verbose"`
-	Pedantic bool   `json:"pedantic"`
-	User     string `json:"user"`
-	Pass     string `json:"pass"`
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	User      string `json:"user"`
+	Pass      string `json:"pass"`
+	AuthToken string `json:"auth_token,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Lang      string `json:"lang,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Protocol  int    `json:"protocol,omitempty"`
+	Echo      *bool  `json:"echo,omitempty"`
+	Headers   bool   `json:"headers,omitempty"`
 }
 
 func (self *writeConnect) write(wr *bufio.Writer) error {
@@ -148,26 +155,47 @@ func (self *writeUnsubscribe) write(wr *bufio.Writer) error {
 type writePublish struct {
 	Subject string
 	ReplyTo string
+	Header  Header
 	Message []byte
 }
 
 func (self *writePublish) write(wr *bufio.Writer) error {
 	var err error
 	var protocol string
-
-	protocol = fmt.Sprintf("PUB %s", self.Subject)
+	var header []byte
+
+	// Messages with a header are published with HPUB
+	if len(self.Header) > 0 {
+		header, err = self.Header.encode()
+		if err != nil {
+			return err
+		}
+
+		protocol = fmt.Sprintf("HPUB %s", self.Subject)
+	} else {
+		protocol = fmt.Sprintf("PUB %s", self.Subject)
+	}
 
 	if len(self.ReplyTo) > 0 {
 		protocol += fmt.Sprintf(" %s", self.ReplyTo)
 	}
 
-	protocol += fmt.Sprintf(" %d\r\n", len(self.Message))
+	if header != nil {
+		protocol += fmt.Sprintf(" %d", len(header))
+	}
+
+	protocol += fmt.Sprintf(" %d\r\n", len(header)+len(self.Message))
 
 	_, err = wr.WriteString(protocol)
 	if err != nil {
 		return err
 	}
 
+	_, err = wr.Write(header)
+	if err != nil {
+		return err
+	}
+
 	_, err = wr.Write(self.Message)
 	if err != nil {
 		return err
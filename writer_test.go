@@ -45,6 +45,25 @@ func TestWriteConnect(t *testing.T) {
 	testWriteMatch(t, obj, expected)
 }
 
+func TestWriteConnectWithOptions(t *testing.T) {
+	var echo = false
+	var obj = &writeConnect{
+		AuthToken: "t0k3n",
+		Name:      "app",
+		Lang:      "go",
+		Version:   "1.0",
+		Protocol:  1,
+		Echo:      &echo,
+		Headers:   true,
+	}
+
+	var expected = "CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":\"\",\"pass\":\"\"," +
+		"\"auth_token\":\"t0k3n\",\"name\":\"app\",\"lang\":\"go\",\"version\":\"1.0\"," +
+		"\"protocol\":1,\"echo\":false,\"headers\":true}\r\n"
+
+	testWriteMatch(t, obj, expected)
+}
+
 func TestWritePing(t *testing.T) {
 	var obj = &writePing{}
 
@@ -127,3 +146,16 @@ func TestWritePublishWithReplyTo(t *testing.T) {
 
 	testWriteMatch(t, obj, expected)
 }
+
+func TestWritePublishWithHeader(t *testing.T) {
+	var obj = &writePublish{
+		Subject: "subject",
+		ReplyTo: "reply",
+		Header:  Header{"Trace": {"abc"}},
+		Message: []byte("message"),
+	}
+
+	var expected = "HPUB subject reply 24 31\r\nNATS/1.0\r\nTrace: abc\r\n\r\nmessage\r\n"
+
+	testWriteMatch(t, obj, expected)
+}